@@ -0,0 +1,97 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"simple-cex/engine"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- ADMIN: Điều chỉnh số dư (dual approval) ---
+
+type balanceAdjustmentRequest struct {
+	UserID     int     `json:"user_id" binding:"required"`
+	Asset      string  `json:"asset" binding:"required"`
+	Amount     float64 `json:"amount" binding:"required"` // Âm để trừ tiền
+	ReasonCode string  `json:"reason_code" binding:"required"`
+	Note       string  `json:"note"`
+}
+
+type adjustmentDecisionRequest struct {
+	Note string `json:"note"`
+}
+
+func adjustmentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, engine.ErrAdjustmentNotFound), errors.Is(err, engine.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, engine.ErrAdjustmentDecided):
+		return http.StatusConflict
+	case errors.Is(err, engine.ErrSelfApproval), errors.Is(err, engine.ErrLinkedApproval):
+		return http.StatusForbidden
+	case errors.Is(err, engine.ErrInvalidReasonCode),
+		errors.Is(err, engine.ErrInvalidAdjustmentValue),
+		errors.Is(err, engine.ErrInsufficientBalance):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) handleAdminRequestAdjustment(c *gin.Context) {
+	var req balanceAdjustmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	a, err := engine.RequestBalanceAdjustment(s.db, currentUserID(c), req.UserID, req.Asset, req.Amount, req.ReasonCode, req.Note)
+	if err != nil {
+		c.JSON(adjustmentErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+func (s *Server) handleAdminListAdjustments(c *gin.Context) {
+	adjustments, err := engine.ListBalanceAdjustments(s.db, c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, adjustments)
+}
+
+func (s *Server) decideAdjustment(c *gin.Context, approve bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid adjustment id"})
+		return
+	}
+	var req adjustmentDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	decide := engine.RejectBalanceAdjustment
+	if approve {
+		decide = engine.ApproveBalanceAdjustment
+	}
+	a, err := decide(s.db, id, currentUserID(c), req.Note)
+	if err != nil {
+		c.JSON(adjustmentErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+func (s *Server) handleAdminApproveAdjustment(c *gin.Context) {
+	s.decideAdjustment(c, true)
+}
+
+func (s *Server) handleAdminRejectAdjustment(c *gin.Context) {
+	s.decideAdjustment(c, false)
+}
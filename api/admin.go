@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"simple-cex/engine"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- ADMIN: Settlement & market ---
+
+type haltMarketRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (s *Server) handleAdminSettlementStatus(c *gin.Context) {
+	status, err := s.engine.SettlementStatus()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *Server) handleAdminListDeadLetters(c *gin.Context) {
+	letters, err := s.engine.ListDeadLetters(c.Query("all") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, letters)
+}
+
+func (s *Server) handleAdminGetDeadLetter(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dead letter id"})
+		return
+	}
+
+	letter, err := s.engine.GetDeadLetter(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, engine.ErrDeadLetterNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, letter)
+}
+
+func (s *Server) handleAdminReplayDeadLetter(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dead letter id"})
+		return
+	}
+	// Replay lỗi lần nữa thì batch quay lại hàng đợi retry, không phải lỗi của request
+	if err := s.engine.ReplayDeadLetter(id, currentUserID(c)); err != nil {
+		if errors.Is(err, engine.ErrDeadLetterNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "Replay queued, settlement still failing", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Dead letter replayed"})
+}
+
+func (s *Server) handleAdminHaltMarket(c *gin.Context) {
+	symbol := c.Param("symbol")
+	var req haltMarketRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "halted by admin"
+	}
+
+	if _, ok := s.engine.OrderBooks[symbol]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Symbol not found"})
+		return
+	}
+	s.engine.HaltMarket(symbol, req.Reason)
+	c.JSON(http.StatusOK, gin.H{"symbol": symbol, "halted": true, "reason": req.Reason})
+}
+
+func (s *Server) handleAdminResumeMarket(c *gin.Context) {
+	symbol := c.Param("symbol")
+	if err := s.engine.ResumeMarket(symbol); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"symbol": symbol, "halted": false})
+}
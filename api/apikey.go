@@ -0,0 +1,199 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"simple-cex/engine"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- API KEY (HMAC) ---
+// Mỗi request ký bằng API key gửi 3 header:
+//   X-API-KEY:       api key
+//   X-API-TIMESTAMP: unix milliseconds
+//   X-API-SIGNATURE: hex(HMAC-SHA256(secret, timestamp + METHOD + path?query + body))
+
+const (
+	headerAPIKey       = "X-API-KEY"
+	headerAPITimestamp = "X-API-TIMESTAMP"
+	headerAPISignature = "X-API-SIGNATURE"
+
+	// Key lưu *engine.APIKey trong gin.Context khi request xác thực bằng API key
+	ctxAPIKey = "apiKey"
+)
+
+// Timestamp lệch quá khoảng này so với giờ server thì bị từ chối
+const APIKeyRecvWindow = 5 * time.Second
+
+type createAPIKeyRequest struct {
+	Label       string   `json:"label"`
+	Permissions []string `json:"permissions"` // read, trade, withdraw (mặc định: read)
+	AllowedIPs  []string `json:"allowed_ips"`
+	OTP         string   `json:"otp"` // Bắt buộc nếu user đã bật 2FA
+}
+
+// replayCache: Nhớ các chữ ký đã dùng trong cửa sổ thời gian để chặn gửi lại y hệt request.
+// queue giữ thứ tự thời gian nên chỉ cần bỏ các phần tử hết hạn ở đầu, không duyệt cả map.
+type replayCache struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	queue []replayEntry
+}
+
+type replayEntry struct {
+	signature string
+	at        time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]time.Time)}
+}
+
+// checkAndStore trả về false nếu chữ ký đã được dùng
+func (r *replayCache) checkAndStore(signature string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Chữ ký cũ hơn 2 lần cửa sổ không thể hợp lệ nữa (timestamp đã hết hạn)
+	for len(r.queue) > 0 && now.Sub(r.queue[0].at) > 2*APIKeyRecvWindow {
+		delete(r.seen, r.queue[0].signature)
+		r.queue = r.queue[1:]
+	}
+
+	if _, ok := r.seen[signature]; ok {
+		return false
+	}
+	r.seen[signature] = now
+	r.queue = append(r.queue, replayEntry{signature, now})
+	return true
+}
+
+// authenticateAPIKey: Kiểm tra key, IP, timestamp, chữ ký và chống replay
+func (s *Server) authenticateAPIKey(c *gin.Context) (*engine.APIKey, int, error) {
+	ts := c.GetHeader(headerAPITimestamp)
+	signature := c.GetHeader(headerAPISignature)
+	if ts == "" || signature == "" {
+		return nil, http.StatusUnauthorized, errors.New("missing api timestamp or signature")
+	}
+
+	ms, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, http.StatusUnauthorized, errors.New("invalid api timestamp")
+	}
+	now := time.Now()
+	skew := now.Sub(time.UnixMilli(ms))
+	if skew > APIKeyRecvWindow || skew < -APIKeyRecvWindow {
+		return nil, http.StatusUnauthorized, errors.New("api timestamp outside recv window")
+	}
+
+	key, secret, err := engine.LookupAPIKey(s.db, c.GetHeader(headerAPIKey))
+	if err != nil {
+		if errors.Is(err, engine.ErrInvalidAPIKey) {
+			return nil, http.StatusUnauthorized, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if !keyAllowsClient(c, key) {
+		return nil, http.StatusForbidden, errors.New("ip address not allowed for this api key")
+	}
+
+	// Đọc body để ký rồi trả lại cho handler
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	if !engine.VerifySignature(secret, ts, c.Request.Method, c.Request.URL.RequestURI(), body, signature) {
+		return nil, http.StatusUnauthorized, errors.New("invalid api signature")
+	}
+	if !s.replay.checkAndStore(signature, now) {
+		return nil, http.StatusUnauthorized, errors.New("replayed request")
+	}
+	return key, 0, nil
+}
+
+// keyAllowsClient: IP lấy theo ClientIP, chỉ tin X-Forwarded-For từ proxy đã cấu hình (xem NewServer)
+func keyAllowsClient(c *gin.Context, key *engine.APIKey) bool {
+	return key.AllowsIP(c.ClientIP())
+}
+
+// requirePermission: Request bằng session được toàn quyền, bằng API key thì key phải có quyền perm
+func (s *Server) requirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if v, ok := c.Get(ctxAPIKey); ok && !v.(*engine.APIKey).HasPermission(perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "api key lacks permission: " + perm})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireSession: Các thao tác quản trị tài khoản không cho phép dùng API key
+func (s *Server) requireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get(ctxAPIKey); ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "this endpoint requires a login session"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func apiKeyErrorStatus(err error) int {
+	if errors.Is(err, engine.ErrAPIKeyNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+func (s *Server) handleCreateAPIKey(c *gin.Context) {
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !s.checkSecondFactor(c, req.OTP) {
+		return
+	}
+
+	userID := currentUserID(c)
+	key, secret, err := engine.CreateAPIKey(s.db, userID, userID, req.Label, req.Permissions, req.AllowedIPs)
+	if err != nil {
+		c.JSON(apiKeyErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"key": key, "secret": secret})
+}
+
+func (s *Server) handleListAPIKeys(c *gin.Context) {
+	keys, err := engine.ListAPIKeys(s.db, currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// handleRevokeAPIKey: Thu hồi key của chính mình hoặc key đã tạo cho sub-account
+func (s *Server) handleRevokeAPIKey(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid api key id"})
+		return
+	}
+
+	if err := engine.RevokeAPIKey(s.db, currentUserID(c), id); err != nil {
+		c.JSON(apiKeyErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	s.wsManager.CloseAPIKey(id)
+	c.JSON(http.StatusOK, gin.H{"id": id, "revoked": true})
+}
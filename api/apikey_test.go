@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"simple-cex/engine"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// X-Forwarded-For do client tự gửi không được dùng để vượt allowlist IP của API key
+func TestAPIKeyIPAllowlistIgnoresSpoofedForwardedFor(t *testing.T) {
+	s := newTestServer(t)
+	key := &engine.APIKey{AllowedIPs: []string{"10.0.0.1"}}
+	s.router.GET("/test/key-ip", func(c *gin.Context) {
+		if !keyAllowsClient(c, key) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"spoofed header", "203.0.113.9:40000", "10.0.0.1", http.StatusForbidden},
+		{"allowed address", "10.0.0.1:40000", "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/test/key-ip", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	r := newReplayCache()
+	now := time.Now()
+	if !r.checkAndStore("a", now) {
+		t.Fatal("first use of signature rejected")
+	}
+	if r.checkAndStore("a", now.Add(time.Second)) {
+		t.Fatal("replayed signature accepted")
+	}
+
+	// Sau 2 lần cửa sổ, chữ ký cũ bị dọn khỏi cache
+	later := now.Add(2*APIKeyRecvWindow + time.Second)
+	if !r.checkAndStore("b", later) {
+		t.Fatal("new signature rejected")
+	}
+	if _, ok := r.seen["a"]; ok || len(r.queue) != 1 {
+		t.Fatalf("expired signature not pruned: seen=%v queue=%d", r.seen, len(r.queue))
+	}
+}
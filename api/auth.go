@@ -0,0 +1,127 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"simple-cex/engine"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Key lưu userID đã xác thực trong gin.Context
+const ctxUserID = "userID"
+
+type credentialsRequest struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type loginRequest struct {
+	credentialsRequest
+	OTP string `json:"otp"` // TOTP hoặc recovery code, bắt buộc nếu user đã bật 2FA
+}
+
+// bearerToken lấy token từ header "Authorization: Bearer <token>"
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// requireAuth: Middleware bắt buộc có session hợp lệ hoặc request ký bằng API key
+func (s *Server) requireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader(headerAPIKey) != "" {
+			key, status, err := s.authenticateAPIKey(c)
+			if err != nil {
+				c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+				return
+			}
+			c.Set(ctxUserID, key.UserID)
+			c.Set(ctxAPIKey, key)
+			c.Next()
+			return
+		}
+
+		userID, err := engine.Authenticate(s.db, bearerToken(c))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, engine.ErrInvalidSession) {
+				status = http.StatusUnauthorized
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(ctxUserID, userID)
+		c.Next()
+	}
+}
+
+// currentUserID: User đang đăng nhập (chỉ dùng sau requireAuth)
+func currentUserID(c *gin.Context) int {
+	return c.GetInt(ctxUserID)
+}
+
+func (s *Server) handleSignup(c *gin.Context) {
+	var req credentialsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := engine.RegisterUser(s.db, req.Email, req.Password)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, engine.ErrEmailTaken) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, err := engine.CreateSession(s.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+func (s *Server) handleLogin(c *gin.Context) {
+	var req loginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, err := engine.Login(s.db, req.Email, req.Password, req.OTP)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, engine.ErrInvalidCredentials):
+			status = http.StatusUnauthorized
+		case errors.Is(err, engine.ErrOTPRequired), errors.Is(err, engine.ErrInvalidOTP):
+			// Client hiện ô nhập mã 2FA rồi gửi lại kèm "otp"
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "2fa_required": true})
+			return
+		case errors.Is(err, engine.ErrOTPLocked):
+			status = http.StatusTooManyRequests
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+func (s *Server) handleLogout(c *gin.Context) {
+	token := bearerToken(c)
+	if err := engine.Logout(s.db, token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.wsManager.CloseSession(token)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
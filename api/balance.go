@@ -0,0 +1,19 @@
+package api
+
+import (
+	"net/http"
+	"simple-cex/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- BALANCE HANDLERS ---
+
+func (s *Server) handleGetBalances(c *gin.Context) {
+	balances, err := engine.GetBalances(s.db, currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, balances)
+}
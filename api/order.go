@@ -0,0 +1,203 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"simple-cex/engine"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// --- ORDER HANDLERS (tra cứu / huỷ) ---
+
+// parseOrderFilter: symbol, side, status, start_time/end_time (unix ms), before_id, limit
+func parseOrderFilter(c *gin.Context) (engine.OrderFilter, error) {
+	f := engine.OrderFilter{
+		Symbol: strings.ToUpper(c.Query("symbol")),
+		Side:   strings.ToUpper(c.Query("side")),
+		Status: strings.ToUpper(c.Query("status")),
+	}
+	if err := parseTimeRange(c, &f.From, &f.To); err != nil {
+		return f, err
+	}
+	if v := c.Query("before_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid before_id")
+		}
+		f.BeforeID = id
+	}
+	f.Limit, _ = strconv.Atoi(c.Query("limit"))
+	return f, nil
+}
+
+// parseTimeRange: start_time/end_time tính bằng unix ms
+func parseTimeRange(c *gin.Context, from, to *time.Time) error {
+	return parseTimeParams(c, "start_time", "end_time", from, to)
+}
+
+// parseTimeParams: Như parseTimeRange nhưng với tên query tuỳ chọn
+func parseTimeParams(c *gin.Context, fromName, toName string, from, to *time.Time) error {
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{fromName, from}, {toName, to}} {
+		if v := c.Query(p.name); v != "" {
+			ms, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s", p.name)
+			}
+			*p.dst = time.UnixMilli(ms).UTC()
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleListOpenOrders(c *gin.Context) {
+	s.listOrders(c, engine.ListOpenOrders)
+}
+
+func (s *Server) handleOrderHistory(c *gin.Context) {
+	s.listOrders(c, engine.ListOrderHistory)
+}
+
+func (s *Server) listOrders(c *gin.Context, list func(*pgxpool.Pool, int, engine.OrderFilter) ([]engine.OrderInfo, error)) {
+	f, err := parseOrderFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	orders, err := list(s.db, currentUserID(c), f)
+	if err != nil {
+		c.JSON(orderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, orders)
+}
+
+func (s *Server) handleGetOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+
+	order, err := engine.GetOrder(s.db, currentUserID(c), id)
+	if err != nil {
+		c.JSON(orderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+func (s *Server) handleCancelOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+
+	order, err := s.engine.CancelOrder(currentUserID(c), id)
+	if err != nil {
+		c.JSON(orderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+// amendOrderRequest: amount là tổng số lượng mới (kể cả phần đã khớp)
+type amendOrderRequest struct {
+	Price         float64 `json:"price"`
+	Amount        float64 `json:"amount"`
+	ClientOrderID string  `json:"client_order_id"` // Tuỳ chọn, cho lệnh thay thế
+}
+
+func (s *Server) handleAmendOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+	var req amendOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := s.amendOrder(currentUserID(c), id, req)
+	if err != nil {
+		resp := gin.H{"error": err.Error()}
+		if result != nil {
+			resp["result"] = result // Lệnh cũ đã huỷ nhưng đặt lệnh thay thế lỗi
+		}
+		c.JSON(orderErrorStatus(err), resp)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// amendOrder: Dùng chung cho REST và WebSocket. Khi lỗi, result != nil nghĩa là lệnh cũ đã bị huỷ.
+func (s *Server) amendOrder(userID, orderID int, req amendOrderRequest) (*engine.AmendResult, error) {
+	result, err := s.engine.AmendOrder(userID, orderID, req.Price, req.Amount, req.ClientOrderID)
+	if result != nil && result.Order != nil && !result.Order.Duplicate {
+		s.publishMarketUpdates(result.Order.Symbol)
+	}
+	return result, err
+}
+
+// handleCancelAllOrders: Huỷ mọi lệnh đang mở, ?symbol= để chỉ huỷ trong một market
+func (s *Server) handleCancelAllOrders(c *gin.Context) {
+	result, err := s.engine.CancelAllOrders(currentUserID(c), strings.ToUpper(c.Query("symbol")))
+	if err != nil {
+		c.JSON(orderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *Server) handleGetOrderByClientID(c *gin.Context) {
+	order, err := engine.GetOrderByClientID(s.db, currentUserID(c), c.Param("client_order_id"))
+	if err != nil {
+		c.JSON(orderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+func (s *Server) handleCancelOrderByClientID(c *gin.Context) {
+	order, err := s.engine.CancelOrderByClientID(currentUserID(c), c.Param("client_order_id"))
+	if err != nil {
+		c.JSON(orderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+// handleMyTrades: Các lần khớp lệnh của user. Filters: symbol, start_time/end_time, before_id (trade id), limit
+func (s *Server) handleMyTrades(c *gin.Context) {
+	f := engine.TradeFilter{Symbol: strings.ToUpper(c.Query("symbol"))}
+	if err := parseTimeRange(c, &f.From, &f.To); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if v := c.Query("before_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid before_id"})
+			return
+		}
+		f.BeforeID = id
+	}
+	f.Limit, _ = strconv.Atoi(c.Query("limit"))
+
+	trades, err := engine.ListUserTrades(s.db, currentUserID(c), f)
+	if err != nil {
+		c.JSON(orderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, trades)
+}
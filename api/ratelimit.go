@@ -0,0 +1,203 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- RATE LIMIT (token bucket) ---
+
+const (
+	// Mỗi IP có 1200 điểm/phút, mỗi request trừ số điểm bằng weight của endpoint
+	RequestWeightPerMinute = 1200
+
+	// Giới hạn đặt lệnh theo user (tính cả lệnh bị từ chối)
+	OrdersPerSecond = 10
+	OrdersPerDay    = 200000
+
+	// Số kết nối /ws tối đa từ một IP
+	MaxWSConnectionsPerIP = 10
+
+	// Bucket không dùng quá lâu (đã đầy lại) thì xoá cho nhẹ bộ nhớ
+	bucketIdleTTL = 10 * time.Minute
+)
+
+// endpointWeights: Endpoint nặng (truy vấn DB lớn, bcrypt) tốn nhiều điểm hơn. Mặc định là 1.
+var endpointWeights = map[string]int{
+	"/signup":                10,
+	"/login":                 10,
+	"/trades/:symbol":        5,
+	"/trades/:symbol/recent": 2,
+	"/orderbook/:symbol":     2,
+	"/subaccounts/overview":  5,
+	"/orders/history":        5,
+	"/my-trades":             5,
+	"/admin/audit-log":       5,
+}
+
+func endpointWeight(path string) int {
+	if w, ok := endpointWeights[path]; ok {
+		return w
+	}
+	return 1
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter: Mỗi key (IP, userID...) có một bucket dung lượng capacity, hồi refillPerSec điểm/giây
+type rateLimiter struct {
+	mu           sync.Mutex
+	capacity     float64
+	refillPerSec float64
+	buckets      map[string]*tokenBucket
+	lastPrune    time.Time
+}
+
+func newRateLimiter(capacity int, per time.Duration) *rateLimiter {
+	return &rateLimiter{
+		capacity:     float64(capacity),
+		refillPerSec: float64(capacity) / per.Seconds(),
+		buckets:      make(map[string]*tokenBucket),
+		lastPrune:    time.Now(),
+	}
+}
+
+// rateLimitResult: Thông tin để trả về trong các header RateLimit-*
+type rateLimitResult struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	resetAfter time.Duration // Thời gian để bucket đầy lại
+	retryAfter time.Duration // Chỉ có ý nghĩa khi !allowed
+}
+
+// take trừ weight điểm nếu đủ, không đủ thì không trừ gì
+func (l *rateLimiter) take(key string, weight int, now time.Time) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > bucketIdleTTL {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdleTTL {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.capacity, b.tokens+now.Sub(b.last).Seconds()*l.refillPerSec)
+	b.last = now
+
+	res := rateLimitResult{limit: int(l.capacity)}
+	if b.tokens >= float64(weight) {
+		b.tokens -= float64(weight)
+		res.allowed = true
+	} else {
+		res.retryAfter = time.Duration((float64(weight) - b.tokens) / l.refillPerSec * float64(time.Second))
+	}
+	res.remaining = int(b.tokens)
+	res.resetAfter = time.Duration((l.capacity - b.tokens) / l.refillPerSec * float64(time.Second))
+	return res
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+func setRateLimitHeaders(c *gin.Context, res rateLimitResult) {
+	c.Header("RateLimit-Limit", strconv.Itoa(res.limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(res.remaining))
+	c.Header("RateLimit-Reset", ceilSeconds(res.resetAfter))
+}
+
+func abortTooManyRequests(c *gin.Context, res rateLimitResult, msg string) {
+	c.Header("Retry-After", ceilSeconds(res.retryAfter))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error":          msg,
+		"retry_after_ms": res.retryAfter.Milliseconds(),
+	})
+}
+
+// rateLimitByIP: Middleware toàn cục, trừ điểm theo weight của endpoint
+func (s *Server) rateLimitByIP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		weight := endpointWeight(c.FullPath())
+		res := s.ipLimiter.take(c.ClientIP(), weight, time.Now())
+		setRateLimitHeaders(c, res)
+		if !res.allowed {
+			abortTooManyRequests(c, res, "request weight limit exceeded")
+			return
+		}
+		c.Next()
+	}
+}
+
+// allowOrder: Kiểm tra cả giới hạn theo giây và theo ngày của user.
+// Chỉ trừ bucket ngày khi bucket giây còn chỗ để lệnh bị chặn không tính vào hạn mức ngày.
+func (s *Server) allowOrder(userID int) (rateLimitResult, string) {
+	key := strconv.Itoa(userID)
+	now := time.Now()
+	if res := s.orderSecLimiter.take(key, 1, now); !res.allowed {
+		return res, fmt.Sprintf("order rate limit exceeded: %d orders/second", OrdersPerSecond)
+	}
+	if res := s.orderDayLimiter.take(key, 1, now); !res.allowed {
+		return res, fmt.Sprintf("order rate limit exceeded: %d orders/day", OrdersPerDay)
+	}
+	return rateLimitResult{allowed: true}, ""
+}
+
+// rateLimitOrders: Middleware cho các API đặt lệnh, đặt sau requireAuth
+func (s *Server) rateLimitOrders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if res, msg := s.allowOrder(currentUserID(c)); !res.allowed {
+			abortTooManyRequests(c, res, msg)
+			return
+		}
+		c.Next()
+	}
+}
+
+// connLimiter: Đếm số kết nối đang mở theo IP
+type connLimiter struct {
+	mu    sync.Mutex
+	max   int
+	conns map[string]int
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, conns: make(map[string]int)}
+}
+
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+		return
+	}
+	l.conns[ip]--
+}
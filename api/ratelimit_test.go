@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getWithForwardedFor(s *Server, remoteAddr, forwarded string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("X-Forwarded-For", forwarded)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w.Code
+}
+
+// Đổi X-Forwarded-For mỗi request không được tạo bucket mới cho cùng một kết nối
+func TestRateLimitByIPIgnoresRotatedForwardedFor(t *testing.T) {
+	s := newTestServer(t)
+	s.ipLimiter = newRateLimiter(2, time.Minute)
+
+	want := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i, forwarded := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if got := getWithForwardedFor(s, "203.0.113.9:40000", forwarded); got != want[i] {
+			t.Errorf("request %d: got status %d, want %d", i, got, want[i])
+		}
+	}
+}
+
+// Sau proxy đã khai báo, mỗi client thật có bucket riêng
+func TestRateLimitByIPTrustedProxy(t *testing.T) {
+	s := newTestServer(t)
+	s.ipLimiter = newRateLimiter(1, time.Minute)
+	if err := s.SetTrustedProxies([]string{"192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, forwarded := range []string{"10.0.0.1", "10.0.0.2"} {
+		if got := getWithForwardedFor(s, "192.0.2.1:40000", forwarded); got != http.StatusOK {
+			t.Errorf("client %s: got status %d, want %d", forwarded, got, http.StatusOK)
+		}
+	}
+	if got := getWithForwardedFor(s, "192.0.2.1:40000", "10.0.0.1"); got != http.StatusTooManyRequests {
+		t.Errorf("repeat client: got status %d, want %d", got, http.StatusTooManyRequests)
+	}
+}
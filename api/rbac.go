@@ -0,0 +1,206 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"simple-cex/engine"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- ADMIN: Phân quyền & audit log ---
+
+// Key lưu role của user trong gin.Context (chỉ có trong nhóm /admin)
+const ctxRole = "role"
+
+type setRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// requireStaff: Chặn trader khỏi toàn bộ /admin, lưu role cho các middleware sau
+func (s *Server) requireStaff() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role, err := engine.GetUserRole(s.db, currentUserID(c))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !engine.IsStaffRole(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+			return
+		}
+		c.Set(ctxRole, role)
+		c.Next()
+	}
+}
+
+// requireAdminPermission: Kiểm tra quyền của role cho từng API admin
+func (s *Server) requireAdminPermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !engine.RoleHasPermission(c.GetString(ctxRole), perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing admin permission: " + perm})
+			return
+		}
+		c.Next()
+	}
+}
+
+// auditAdmin: Ghi lại mọi thao tác thay đổi dữ liệu trên /admin (kể cả khi bị từ chối hay lỗi)
+func (s *Server) auditAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		c.Next()
+
+		pathParams := make(map[string]string, len(c.Params))
+		for _, p := range c.Params {
+			pathParams[p.Key] = p.Value
+		}
+		params := gin.H{"path": pathParams, "query": c.Request.URL.Query()}
+		if len(body) > 0 {
+			if json.Valid(body) {
+				params["body"] = json.RawMessage(body)
+			} else {
+				params["body"] = string(body)
+			}
+		}
+		raw, _ := json.Marshal(params)
+
+		entry := engine.AdminAuditEntry{
+			AdminID:    currentUserID(c),
+			Role:       c.GetString(ctxRole),
+			Action:     c.Request.Method + " " + c.FullPath(),
+			Params:     raw,
+			StatusCode: c.Writer.Status(),
+			IP:         c.ClientIP(),
+		}
+		if err := engine.RecordAdminAction(s.db, entry); err != nil {
+			log.Printf("auditAdmin: failed to record %s by user %d: %v", entry.Action, entry.AdminID, err)
+		}
+	}
+}
+
+func (s *Server) handleAdminAuditLog(c *gin.Context) {
+	var f engine.AuditLogFilter
+	f.Action = c.Query("action")
+	if v := c.Query("admin_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid admin_id"})
+			return
+		}
+		f.AdminID = id
+	}
+	if v := c.Query("before_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid before_id"})
+			return
+		}
+		f.BeforeID = id
+	}
+	f.Limit, _ = strconv.Atoi(c.Query("limit"))
+
+	entries, err := engine.ListAdminAuditLog(s.db, f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+func roleErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, engine.ErrInvalidRole):
+		return http.StatusBadRequest
+	case errors.Is(err, engine.ErrUserNotFound), errors.Is(err, engine.ErrRoleGrantNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, engine.ErrRoleGrantDecided):
+		return http.StatusConflict
+	case errors.Is(err, engine.ErrRoleGrantSelfReview):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// handleAdminSetRole: Role admin chỉ tạo yêu cầu (202), admin thứ hai duyệt qua /admin/role-grants/:id/approve
+func (s *Server) handleAdminSetRole(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	var req setRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	adminID := currentUserID(c)
+	if userID == adminID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot change your own role"})
+		return
+	}
+
+	if engine.RequiresDualControl(req.Role) {
+		grant, err := engine.RequestRoleGrant(s.db, adminID, userID, req.Role)
+		if err != nil {
+			c.JSON(roleErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, grant)
+		return
+	}
+
+	if err := engine.SetUserRole(s.db, adminID, userID, req.Role); err != nil {
+		c.JSON(roleErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "role": req.Role})
+}
+
+func (s *Server) handleAdminListRoleGrants(c *gin.Context) {
+	grants, err := engine.ListRoleGrants(s.db, c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, grants)
+}
+
+func (s *Server) decideRoleGrant(c *gin.Context, approve bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role grant id"})
+		return
+	}
+	grant, err := engine.DecideRoleGrant(s.db, id, currentUserID(c), approve)
+	if err != nil {
+		c.JSON(roleErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, grant)
+}
+
+func (s *Server) handleAdminApproveRoleGrant(c *gin.Context) {
+	s.decideRoleGrant(c, true)
+}
+
+func (s *Server) handleAdminRejectRoleGrant(c *gin.Context) {
+	s.decideRoleGrant(c, false)
+}
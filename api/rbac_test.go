@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"simple-cex/engine"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	return NewServer(&engine.Engine{}, nil)
+}
+
+// Mọi API /admin phải bị chặn khi chưa đăng nhập, trước khi chạm tới handler
+func TestAdminRoutesRequireAuth(t *testing.T) {
+	s := newTestServer(t)
+
+	var checked int
+	for _, r := range s.router.Routes() {
+		if !strings.HasPrefix(r.Path, "/admin/") {
+			continue
+		}
+		checked++
+		path := strings.NewReplacer(":id", "1", ":symbol", "BTC_USDT").Replace(r.Path)
+		req := httptest.NewRequest(r.Method, path, nil)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: got status %d, want %d", r.Method, r.Path, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if checked == 0 {
+		t.Fatal("no /admin routes registered")
+	}
+}
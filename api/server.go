@@ -1,7 +1,7 @@
 package api
 
 import (
-	"context"
+	"errors"
 	"log"
 	"net/http"
 	"simple-cex/engine"
@@ -18,17 +18,44 @@ type Server struct {
 	router    *gin.Engine
 	wsManager *WSManager
 	db        *pgxpool.Pool
+	replay    *replayCache
+
+	ipLimiter       *rateLimiter // Điểm request theo IP
+	orderSecLimiter *rateLimiter // Số lệnh/giây theo user
+	orderDayLimiter *rateLimiter // Số lệnh/ngày theo user
 }
 
 // Khởi tạo Server
 func NewServer(eng *engine.Engine, db *pgxpool.Pool) *Server {
 	server := &Server{
-		engine:    eng,
-		router:    gin.Default(),
-		wsManager: NewWSManager(),
-		db:        db,
+		engine: eng,
+		router: gin.Default(),
+		db:     db,
+		replay: newReplayCache(),
+
+		ipLimiter:       newRateLimiter(RequestWeightPerMinute, time.Minute),
+		orderSecLimiter: newRateLimiter(OrdersPerSecond, time.Second),
+		orderDayLimiter: newRateLimiter(OrdersPerDay, 24*time.Hour),
+	}
+	// Mặc định không tin proxy nào: ClientIP là địa chỉ kết nối thật, X-Forwarded-For giả mạo không qua được
+	// allowlist IP của API key, rate limit theo IP hay giới hạn kết nối /ws (xem SetTrustedProxies)
+	if err := server.router.SetTrustedProxies(nil); err != nil {
+		log.Printf("NewServer: cannot reset trusted proxies: %v", err)
 	}
-	go server.wsManager.Run()
+	server.wsManager = NewWSManager(func(token string) (int, error) {
+		return engine.Authenticate(db, token)
+	}, eng.HasSymbol)
+	eng.OnBalanceUpdate(server.pushBalanceUpdate)
+	eng.OnOrderEvent(server.pushOrderEvent)
+	eng.OnFill(server.pushFill)
+	eng.OnDepthUpdate(server.pushDepthUpdate)
+	eng.OnTrade(server.pushTrade)
+	eng.OnCandleUpdate(server.pushKline)
+	server.wsManager.SetRequestHandler(server.handleWSRequest)
+	server.wsManager.SetCredentialCheck(func(caller wsCaller) error {
+		_, err := server.checkWSCredentials(caller)
+		return err
+	})
 	server.setupRoutes()
 	return server
 }
@@ -38,8 +65,9 @@ func (s *Server) setupRoutes() {
 	// Middleware CORS
 	s.router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-KEY, X-API-TIMESTAMP, X-API-SIGNATURE")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -47,33 +75,152 @@ func (s *Server) setupRoutes() {
 		c.Next()
 	})
 
+	// Giới hạn tốc độ theo IP cho mọi API (kể cả /ws)
+	s.router.Use(s.rateLimitByIP())
+
 	// Root endpoint - API information
 	s.router.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "Simple CEX API",
 			"version": "1.0.0",
 			"endpoints": gin.H{
-				"POST /order":            "Đặt lệnh mua/bán",
-				"GET /orderbook/:symbol": "Lấy orderbook",
-				"GET /trades/:symbol":    "Lấy dữ liệu OHLCV cho chart",
-				"GET /ws":                "WebSocket connection",
+				"POST /signup":                   "Đăng ký tài khoản",
+				"POST /login":                    "Đăng nhập, trả về session token",
+				"POST /logout":                   "Huỷ session hiện tại",
+				"POST /order":                    "Đặt lệnh mua/bán",
+				"DELETE /order/:id":              "Huỷ lệnh",
+				"/order/client/:client_order_id": "Xem/huỷ lệnh theo client_order_id",
+				"GET /orderbook/:symbol":         "Lấy orderbook",
+				"GET /trades/:symbol":            "Lấy dữ liệu OHLCV cho chart",
+				"GET /trades/:symbol/recent":     "Các trade gần nhất",
+				"GET /ws":                        "WebSocket connection",
+				"POST /withdrawals":              "Tạo lệnh rút",
+				"GET /withdrawals":               "Lịch sử rút",
+				"GET /withdrawals/limit":         "Hạn mức rút 24h",
+				"/withdrawal-addresses":          "Quản lý whitelist địa chỉ rút",
+				"/admin/withdrawals":             "Hàng đợi duyệt lệnh rút",
+				"/admin/settlements":             "Hàng đợi settlement, dead-letter và replay",
+				"/admin/markets":                 "Dừng/mở lại market",
+				"/admin/users/:id/role":          "Phân quyền trader/support/admin/auditor",
+				"/admin/role-grants":             "Duyệt yêu cầu cấp role admin (cần admin thứ hai)",
+				"GET /admin/audit-log":           "Nhật ký thao tác admin",
+				"/admin/balance-adjustments":     "Điều chỉnh số dư thủ công (cần admin thứ hai duyệt)",
+				"POST /transfers":                "Chuyển tiền nội bộ giữa các tài khoản",
+				"GET /transfers":                 "Lịch sử chuyển nội bộ",
+				"/subaccounts":                   "Quản lý sub-account (master)",
+				"/api-keys":                      "Quản lý API key (HMAC) cho bot",
+				"/2fa":                           "Bật/tắt xác thực hai lớp (TOTP)",
 			},
 		})
 	})
 
-	// API Đặt lệnh
-	s.router.POST("/order", s.handlePlaceOrder)
+	// API Tài khoản
+	s.router.POST("/signup", s.handleSignup)
+	s.router.POST("/login", s.handleLogin)
 
 	// API Lấy Orderbook
 	s.router.GET("/orderbook/:symbol", s.handleGetOrderBook)
 
 	// API Lấy dữ liệu OHLCV cho chart nến
-	s.router.GET("/trades/:symbol", s.handleGetTrades)
+	s.router.GET("/trades/:symbol", s.handleGetCandles)
+	s.router.GET("/trades/:symbol/recent", s.handleRecentTrades)
+
+	// Các API dưới đây cần "Authorization: Bearer <token>" hoặc chữ ký API key (xem apikey.go)
+	private := s.router.Group("/", s.requireAuth())
+	read := s.requirePermission(engine.PermRead)
+	trade := s.requirePermission(engine.PermTrade)
+	withdraw := s.requirePermission(engine.PermWithdraw)
+	session := s.requireSession()
+
+	private.POST("/logout", session, s.handleLogout)
+
+	// API Đặt lệnh
+	private.POST("/order", trade, s.rateLimitOrders(), s.handlePlaceOrder)
+	private.GET("/balances", read, s.handleGetBalances)
+	private.GET("/order/:id", read, s.handleGetOrder)
+	private.PUT("/order/:id", trade, s.rateLimitOrders(), s.handleAmendOrder)
+	private.DELETE("/order/:id", trade, s.handleCancelOrder)
+	private.DELETE("/orders", trade, s.handleCancelAllOrders)
+	private.GET("/orders/open", read, s.handleListOpenOrders)
+	private.GET("/orders/history", read, s.handleOrderHistory)
+	private.GET("/my-trades", read, s.handleMyTrades)
+	private.GET("/order/client/:client_order_id", read, s.handleGetOrderByClientID)
+	private.DELETE("/order/client/:client_order_id", trade, s.handleCancelOrderByClientID)
+
+	// API Rút tiền
+	private.GET("/withdrawal-addresses", read, s.handleListWithdrawalAddresses)
+	private.POST("/withdrawal-addresses", withdraw, s.handleAddWithdrawalAddress)
+	private.DELETE("/withdrawal-addresses/:id", withdraw, s.handleRemoveWithdrawalAddress)
+	private.GET("/withdrawals", read, s.handleListWithdrawals)
+	private.POST("/withdrawals", withdraw, s.handleWithdraw)
+	private.GET("/withdrawals/limit", read, s.handleGetWithdrawalLimit)
+	private.POST("/withdrawals/:id/cancel", withdraw, s.handleCancelWithdrawal)
+
+	// API Chuyển tiền nội bộ
+	private.GET("/transfers", read, s.handleListTransfers)
+	private.POST("/transfers", withdraw, s.handleTransfer)
+
+	// API Sub-account (master quản lý)
+	private.GET("/subaccounts", read, s.handleListSubAccounts)
+	private.POST("/subaccounts", session, s.handleCreateSubAccount)
+	private.GET("/subaccounts/overview", read, s.handleSubAccountOverview)
+	private.POST("/subaccounts/transfer", withdraw, s.handleSubAccountTransfer)
+	private.POST("/subaccounts/:id/freeze", session, s.handleFreezeSubAccount)
+	private.POST("/subaccounts/:id/unfreeze", session, s.handleUnfreezeSubAccount)
+	private.GET("/subaccounts/:id/api-keys", session, s.handleListSubAccountAPIKeys)
+	private.POST("/subaccounts/:id/api-keys", session, s.handleCreateSubAccountAPIKey)
+
+	// API 2FA (TOTP)
+	private.POST("/2fa/setup", session, s.handleSetup2FA)
+	private.POST("/2fa/enable", session, s.handleEnable2FA)
+	private.POST("/2fa/disable", session, s.handleDisable2FA)
+
+	// API Key: chỉ quản lý được khi đăng nhập bằng session
+	private.GET("/api-keys", session, s.handleListAPIKeys)
+	private.POST("/api-keys", session, s.handleCreateAPIKey)
+	private.DELETE("/api-keys/:id", session, s.handleRevokeAPIKey)
+
+	// API Admin: cần role support/admin/auditor, quyền cụ thể theo từng API (engine/rbac.go).
+	// Mọi thao tác POST đều được ghi vào admin_audit_log.
+	admin := s.router.Group("/admin", s.requireAuth(), s.requireSession(), s.requireStaff(), s.auditAdmin())
+	perm := s.requireAdminPermission
+	admin.GET("/withdrawals", perm(engine.AdminPermWithdrawalsRead), s.handleAdminListWithdrawals)
+	admin.POST("/withdrawals/:id/approve", perm(engine.AdminPermWithdrawalsReview), s.handleAdminApproveWithdrawal)
+	admin.POST("/withdrawals/:id/reject", perm(engine.AdminPermWithdrawalsReview), s.handleAdminRejectWithdrawal)
+	admin.POST("/withdrawals/:id/complete", perm(engine.AdminPermWithdrawalsComplete), s.handleAdminCompleteWithdrawal)
+	admin.GET("/settlements", perm(engine.AdminPermSettlementsRead), s.handleAdminSettlementStatus)
+	admin.GET("/settlements/dead", perm(engine.AdminPermSettlementsRead), s.handleAdminListDeadLetters)
+	admin.GET("/settlements/dead/:id", perm(engine.AdminPermSettlementsRead), s.handleAdminGetDeadLetter)
+	admin.POST("/settlements/dead/:id/replay", perm(engine.AdminPermSettlementsReplay), s.handleAdminReplayDeadLetter)
+	admin.POST("/markets/:symbol/halt", perm(engine.AdminPermMarketsHalt), s.handleAdminHaltMarket)
+	admin.POST("/markets/:symbol/resume", perm(engine.AdminPermMarketsHalt), s.handleAdminResumeMarket)
+	admin.GET("/balance-adjustments", perm(engine.AdminPermBalancesRead), s.handleAdminListAdjustments)
+	admin.POST("/balance-adjustments", perm(engine.AdminPermBalancesAdjust), s.handleAdminRequestAdjustment)
+	admin.POST("/balance-adjustments/:id/approve", perm(engine.AdminPermBalancesApprove), s.handleAdminApproveAdjustment)
+	admin.POST("/balance-adjustments/:id/reject", perm(engine.AdminPermBalancesApprove), s.handleAdminRejectAdjustment)
+	admin.POST("/users/:id/role", perm(engine.AdminPermUsersManage), s.handleAdminSetRole)
+	admin.GET("/role-grants", perm(engine.AdminPermUsersManage), s.handleAdminListRoleGrants)
+	admin.POST("/role-grants/:id/approve", perm(engine.AdminPermUsersManage), s.handleAdminApproveRoleGrant)
+	admin.POST("/role-grants/:id/reject", perm(engine.AdminPermUsersManage), s.handleAdminRejectRoleGrant)
+	admin.GET("/audit-log", perm(engine.AdminPermAuditRead), s.handleAdminAuditLog)
 
 	// Route WebSocket
-	s.router.GET("/ws", func(c *gin.Context) {
-		s.wsManager.ServeWS(c)
-	})
+	s.router.GET("/ws", s.handleWS)
+}
+
+// SetWSAllowedOrigins: Xem WSManager.SetAllowedOrigins
+func (s *Server) SetWSAllowedOrigins(origins []string) {
+	s.wsManager.SetAllowedOrigins(origins)
+}
+
+// SetTrustedProxies: Chạy sau reverse proxy thì khai báo IP/CIDR của proxy để lấy IP client từ X-Forwarded-For
+func (s *Server) SetTrustedProxies(proxies []string) error {
+	return s.router.SetTrustedProxies(proxies)
+}
+
+// RunWSRevalidation: Xem WSManager.RunRevalidation
+func (s *Server) RunWSRevalidation() {
+	s.wsManager.RunRevalidation()
 }
 
 // Start server
@@ -85,11 +232,32 @@ func (s *Server) Start(address string) error {
 
 // Request Body cho đặt lệnh
 type placeOrderRequest struct {
-	UserID int     `json:"user_id"`
-	Symbol string  `json:"symbol"`
-	Side   string  `json:"side"`
-	Price  float64 `json:"price"`
-	Amount float64 `json:"amount"`
+	Symbol        string  `json:"symbol"`
+	Side          string  `json:"side"`
+	Price         float64 `json:"price"`
+	Amount        float64 `json:"amount"`
+	ClientOrderID string  `json:"client_order_id"` // Tuỳ chọn: gửi lại cùng ID sẽ nhận về lệnh gốc
+}
+
+// orderErrorStatus: Lỗi nghiệp vụ khi đặt lệnh -> 4xx/503, còn lại là 500
+func orderErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, engine.ErrSymbolNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, engine.ErrMarketHalted):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, engine.ErrAccountFrozen):
+		return http.StatusForbidden
+	case errors.Is(err, engine.ErrOrderNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, engine.ErrOrderNotCancellable), errors.Is(err, engine.ErrSettlementInProgress),
+		errors.Is(err, engine.ErrClientOrderIDConflict):
+		return http.StatusConflict
+	case errors.Is(err, engine.ErrInsufficientBalance), errors.Is(err, engine.ErrInvalidOrder), errors.Is(err, engine.ErrInvalidClientOrderID),
+		errors.Is(err, engine.ErrInvalidOrderFilter), errors.Is(err, engine.ErrInvalidAmend):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
 }
 
 func (s *Server) handlePlaceOrder(c *gin.Context) {
@@ -99,239 +267,146 @@ func (s *Server) handlePlaceOrder(c *gin.Context) {
 		return
 	}
 
-	// 1. Gọi Matching Engine
-	err := s.engine.PlaceOrder(req.UserID, req.Symbol, req.Side, req.Price, req.Amount)
+	// User lấy từ session, không tin user_id trong body
+	result, err := s.placeOrder(currentUserID(c), req)
 	if err != nil {
-		log.Printf("handlePlaceOrder: Error placing order for user %d: %v", req.UserID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(orderErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
+	c.JSON(http.StatusOK, result)
+}
 
-	// 2. Sau khi đặt lệnh xong, gửi Orderbook mới nhất cho tất cả client
-	// Lấy Orderbook hiện tại từ RAM
-	if ob, ok := s.engine.OrderBooks[req.Symbol]; ok {
-		// Giới hạn chỉ gửi 10 orders đầu tiên cho mỗi bên
-		asks := ob.Asks
-		bids := ob.Bids
-
-		// ASKS: Lấy 10 giá thấp nhất (đầu mảng)
-		if len(asks) > 10 {
-			asks = asks[:10]
-		}
-
-		// BIDS: Lấy 10 giá cao nhất (đầu mảng)
-		if len(bids) > 10 {
-			bids = bids[:10]
-		}
-
-		// Tạo message update
-		updateMsg := gin.H{
-			"type":   "ORDERBOOK_UPDATE",
-			"symbol": req.Symbol,
-			"asks":   asks,
-			"bids":   bids,
-		}
-		// Bắn vào kênh broadcast -> Client tự nhận được
-		s.wsManager.broadcast <- updateMsg
+// placeOrder: Dùng chung cho REST và WebSocket
+func (s *Server) placeOrder(userID int, req placeOrderRequest) (*engine.PlaceOrderResult, error) {
+	// 1. Gọi Matching Engine
+	result, err := s.engine.PlaceOrder(userID, req.Symbol, req.Side, req.Price, req.Amount, req.ClientOrderID)
+	if err != nil {
+		log.Printf("placeOrder: Error placing order for user %d: %v", userID, err)
+		return nil, err
 	}
-
-	// 3. Gửi TRADE_UPDATE để chart cập nhật real-time
-	ctx := context.Background()
-	var lastTradePrice, lastTradeAmount float64
-	var lastTradeTime time.Time
-	err = s.db.QueryRow(ctx,
-		`SELECT price, amount, created_at 
-		 FROM trades 
-		 WHERE EXISTS (
-			 SELECT 1 FROM orders WHERE orders.id = trades.maker_order_id AND orders.symbol = $1
-		 )
-		 ORDER BY created_at DESC 
-		 LIMIT 1`,
-		req.Symbol).Scan(&lastTradePrice, &lastTradeAmount, &lastTradeTime)
-
-	if err == nil {
-		// Gửi trade update qua WebSocket
-		tradeUpdateMsg := gin.H{
-			"type":   "TRADE_UPDATE",
-			"symbol": req.Symbol,
-			"price":  lastTradePrice,
-			"amount": lastTradeAmount,
-			"time":   lastTradeTime.Unix() * 1000, // milliseconds
-		}
-		s.wsManager.broadcast <- tradeUpdateMsg
+	if !result.Duplicate {
+		// Lệnh đã được đặt từ lần gửi trước thì sổ lệnh không đổi
+		s.publishMarketUpdates(req.Symbol)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Order placed successfully"})
+	return result, nil
 }
 
-func (s *Server) handleGetOrderBook(c *gin.Context) {
-	symbol := c.Param("symbol")
-
-	// Lấy Orderbook từ RAM
-	ob, ok := s.engine.OrderBooks[symbol]
-	if !ok {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Symbol not found"})
+// publishMarketUpdates: TICKER sau khi có lệnh mới. Sổ lệnh (depth@) và trades (trades@) do engine đẩy lên.
+func (s *Server) publishMarketUpdates(symbol string) {
+	ticker, err := s.engine.Ticker(symbol)
+	if err != nil {
 		return
 	}
+	s.wsManager.Publish(tickerAllTopic, gin.H{
+		"type":       "TICKER",
+		"symbol":     ticker.Symbol,
+		"best_bid":   ticker.BestBid,
+		"best_ask":   ticker.BestAsk,
+		"last_price": ticker.LastPrice,
+	})
+}
 
-	// Giới hạn chỉ trả về 10 orders đầu tiên cho mỗi bên
-	asks := ob.Asks
-	bids := ob.Bids
-
-	if len(asks) > 10 {
-		asks = asks[:10]
-	}
-	if len(bids) > 10 {
-		bids = bids[:10]
-	}
+// pushTrade: Mỗi trade đã settle -> TRADE_UPDATE cho các client subscribe trades@<symbol>
+func (s *Server) pushTrade(t engine.PublicTrade) {
+	s.wsManager.Publish(tradesTopic(t.Symbol), gin.H{
+		"type":       "TRADE_UPDATE",
+		"symbol":     t.Symbol,
+		"trade_id":   t.ID,
+		"price":      t.Price,
+		"amount":     t.Amount,
+		"taker_side": t.TakerSide,
+		"time":       t.CreatedAt.UnixMilli(),
+	})
+}
 
-	// Trả về JSON của Orderbook (Gồm Bids và Asks)
-	c.JSON(http.StatusOK, gin.H{
-		"symbol": ob.Symbol,
-		"asks":   asks,
-		"bids":   bids,
+// pushKline: Update nến đang mở / bản cuối khi hết khung -> KLINE cho kline_<interval>@<symbol>
+func (s *Server) pushKline(u engine.CandleUpdate) {
+	s.wsManager.Publish(klineTopic(u.Interval, u.Symbol), gin.H{
+		"type":     "KLINE",
+		"symbol":   u.Symbol,
+		"interval": u.Interval,
+		"closed":   u.Closed,
+		"candle":   u.Candle,
 	})
 }
 
-// Handler để lấy dữ liệu OHLCV từ trades
-func (s *Server) handleGetTrades(c *gin.Context) {
+// handleRecentTrades: ?limit= số trade (mặc định 50, tối đa 500)
+func (s *Server) handleRecentTrades(c *gin.Context) {
 	symbol := c.Param("symbol")
-	interval := c.DefaultQuery("interval", "1m") // 1m, 5m, 15m, 1h, 4h, 1d
-	limitStr := c.DefaultQuery("limit", "100")
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil {
-		limit = 100
-	}
-
-	// Tính interval trong giây
-	var intervalSeconds int
-	switch interval {
-	case "1m":
-		intervalSeconds = 60
-	case "5m":
-		intervalSeconds = 300
-	case "15m":
-		intervalSeconds = 900
-	case "1h":
-		intervalSeconds = 3600
-	case "4h":
-		intervalSeconds = 14400
-	case "1d":
-		intervalSeconds = 86400
-	default:
-		intervalSeconds = 60
+	if !s.engine.HasSymbol(symbol) {
+		c.JSON(http.StatusNotFound, gin.H{"error": engine.ErrSymbolNotFound.Error()})
+		return
 	}
-
-	ctx := context.Background()
-
-	// Lấy trades từ database - join với orders để lọc theo symbol
-	rows, err := s.db.Query(ctx,
-		`SELECT t.price, t.amount, t.created_at 
-		 FROM trades t
-		 INNER JOIN orders o ON o.id = t.maker_order_id
-		 WHERE o.symbol = $1
-		 ORDER BY t.created_at DESC 
-		 LIMIT $2`,
-		symbol, limit*10) // Lấy nhiều hơn để tính OHLCV
-
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	trades, err := engine.ListRecentTrades(s.db, symbol, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
+	c.JSON(http.StatusOK, trades)
+}
 
-	type Trade struct {
-		Price     float64
-		Amount    float64
-		CreatedAt time.Time
+// handleGetOrderBook: Snapshot sổ lệnh gộp theo mức giá, ?limit= số mức giá mỗi bên (mặc định 100, tối đa 1000).
+// lastUpdateId dùng để nối với các DEPTH_UPDATE trên depth@<symbol>.
+func (s *Server) handleGetOrderBook(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
 	}
 
-	var trades []Trade
-	for rows.Next() {
-		var t Trade
-		if err := rows.Scan(&t.Price, &t.Amount, &t.CreatedAt); err != nil {
-			continue
-		}
-		trades = append(trades, t)
+	depth, err := s.engine.DepthSnapshot(c.Param("symbol"), limit)
+	if err != nil {
+		c.JSON(orderErrorStatus(err), gin.H{"error": err.Error()})
+		return
 	}
+	c.JSON(http.StatusOK, depth)
+}
 
-	// Tính OHLCV theo interval
-	ohlcvMap := make(map[int64]struct {
-		open   float64
-		high   float64
-		low    float64
-		close  float64
-		volume float64
+// pushDepthUpdate: Nhận diff sổ lệnh từ engine, gửi cho các client subscribe depth@<symbol>
+func (s *Server) pushDepthUpdate(u engine.DepthUpdate) {
+	s.wsManager.Publish(depthTopic(u.Symbol), gin.H{
+		"type":          "DEPTH_UPDATE",
+		"symbol":        u.Symbol,
+		"firstUpdateId": u.FirstUpdateID,
+		"lastUpdateId":  u.LastUpdateID,
+		"bids":          u.Bids,
+		"asks":          u.Asks,
 	})
+}
 
-	for _, trade := range trades {
-		// Tính timestamp của nến (làm tròn xuống theo interval)
-		candleTime := trade.CreatedAt.Unix() / int64(intervalSeconds) * int64(intervalSeconds)
-
-		if candle, exists := ohlcvMap[candleTime]; exists {
-			// Cập nhật nến hiện có
-			if trade.Price > candle.high {
-				candle.high = trade.Price
-			}
-			if trade.Price < candle.low {
-				candle.low = trade.Price
-			}
-			candle.close = trade.Price
-			candle.volume += trade.Amount
-			ohlcvMap[candleTime] = candle
-		} else {
-			// Tạo nến mới
-			ohlcvMap[candleTime] = struct {
-				open   float64
-				high   float64
-				low    float64
-				close  float64
-				volume float64
-			}{
-				open:   trade.Price,
-				high:   trade.Price,
-				low:    trade.Price,
-				close:  trade.Price,
-				volume: trade.Amount,
-			}
-		}
-	}
-
-	// Chuyển đổi map sang slice và sắp xếp theo thời gian
-	type OHLCV struct {
-		Time   int64   `json:"time"`
-		Open   float64 `json:"open"`
-		High   float64 `json:"high"`
-		Low    float64 `json:"low"`
-		Close  float64 `json:"close"`
-		Volume float64 `json:"volume"`
+// handleGetCandles: Nến OHLCV đã tổng hợp sẵn (bảng candles).
+// ?interval=1m|5m|15m|1h|4h|1d (mặc định 1m), ?limit= (mặc định 100, tối đa 1000),
+// startTime/endTime (unix ms, xem parseCandleTimeRange)
+func (s *Server) handleGetCandles(c *gin.Context) {
+	symbol := c.Param("symbol")
+	if !s.engine.HasSymbol(symbol) {
+		c.JSON(http.StatusNotFound, gin.H{"error": engine.ErrSymbolNotFound.Error()})
+		return
 	}
-
-	var result []OHLCV
-	for time, candle := range ohlcvMap {
-		result = append(result, OHLCV{
-			Time:   time * 1000, // Chuyển sang milliseconds
-			Open:   candle.open,
-			High:   candle.high,
-			Low:    candle.low,
-			Close:  candle.close,
-			Volume: candle.volume,
-		})
+	var from, to time.Time
+	if err := parseCandleTimeRange(c, &from, &to); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
 
-	// Sắp xếp theo thời gian tăng dần
-	for i := 0; i < len(result)-1; i++ {
-		for j := i + 1; j < len(result); j++ {
-			if result[i].Time > result[j].Time {
-				result[i], result[j] = result[j], result[i]
-			}
+	candles, err := engine.ListCandles(s.db, symbol, c.DefaultQuery("interval", "1m"), from, to, limit)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, engine.ErrInvalidCandleQuery) {
+			status = http.StatusBadRequest
 		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
 	}
+	c.JSON(http.StatusOK, candles)
+}
 
-	// Giới hạn số lượng
-	if len(result) > limit {
-		result = result[len(result)-limit:]
+// parseCandleTimeRange: startTime/endTime, hoặc start_time/end_time (unix ms)
+func parseCandleTimeRange(c *gin.Context, from, to *time.Time) error {
+	if err := parseTimeRange(c, from, to); err != nil {
+		return err
 	}
-
-	c.JSON(http.StatusOK, result)
+	return parseTimeParams(c, "startTime", "endTime", from, to)
 }
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Nến nhận startTime/endTime theo request, vẫn chấp nhận start_time/end_time như các API khác
+func TestCandleTimeRangeParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, query := range []string{
+		"startTime=1700000000000&endTime=1700000060000",
+		"start_time=1700000000000&end_time=1700000060000",
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/trades/BTC_USDT?"+query, nil)
+
+		var from, to time.Time
+		if err := parseCandleTimeRange(c, &from, &to); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if from.UnixMilli() != 1700000000000 || to.UnixMilli() != 1700000060000 {
+			t.Errorf("%s: got %v - %v", query, from, to)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"simple-cex/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- PRIVATE WEBSOCKET STREAMS ---
+// Xác thực theo một trong hai cách:
+//   - Bot: gửi header X-API-KEY/X-API-TIMESTAMP/X-API-SIGNATURE khi upgrade (ký "GET /ws", body rỗng), key cần quyền read
+//   - Trình duyệt: sau khi kết nối gửi {"op": "auth", "token": "<session token>"}
+// Sau đó kết nối nhận BALANCE_UPDATE, ORDER_UPDATE và FILL của riêng user.
+
+func (s *Server) handleWS(c *gin.Context) {
+	var apiKey *engine.APIKey
+	if c.GetHeader(headerAPIKey) != "" {
+		key, status, err := s.authenticateAPIKey(c)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		if !key.HasPermission(engine.PermRead) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "api key lacks permission: " + engine.PermRead})
+			return
+		}
+		apiKey = key
+	}
+	s.wsManager.ServeWS(c, apiKey)
+}
+
+// pushBalanceUpdate: Nhận BalanceUpdate từ engine, đẩy vào kênh riêng của user trên /ws
+func (s *Server) pushBalanceUpdate(u engine.BalanceUpdate) {
+	s.wsManager.SendToUser(u.UserID, gin.H{
+		"type":     "BALANCE_UPDATE",
+		"balances": u.Balances,
+	})
+}
+
+func (s *Server) pushOrderEvent(ev engine.OrderEvent) {
+	s.wsManager.SendToUser(ev.Order.UserID, gin.H{
+		"type":   "ORDER_UPDATE",
+		"event":  ev.Event,
+		"order":  ev.Order,
+		"reason": ev.Reason,
+	})
+}
+
+func (s *Server) pushFill(f engine.FillEvent) {
+	s.wsManager.SendToUser(f.UserID, gin.H{
+		"type": "FILL",
+		"fill": f.UserTrade,
+	})
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"simple-cex/engine"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- SUB-ACCOUNT HANDLERS ---
+// User đang đăng nhập luôn là tài khoản master
+
+type createSubAccountRequest struct {
+	Label string `json:"label" binding:"required"`
+}
+
+type subAccountTransferRequest struct {
+	FromUserID     int     `json:"from_user_id" binding:"required"`
+	ToUserID       int     `json:"to_user_id" binding:"required"`
+	Asset          string  `json:"asset" binding:"required"`
+	Amount         float64 `json:"amount" binding:"required"`
+	IdempotencyKey string  `json:"idempotency_key" binding:"required"`
+}
+
+func (s *Server) handleCreateSubAccount(c *gin.Context) {
+	var req createSubAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sub, err := engine.CreateSubAccount(s.db, currentUserID(c), req.Label)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sub)
+}
+
+func (s *Server) handleListSubAccounts(c *gin.Context) {
+	userID := currentUserID(c)
+	subs, err := engine.ListSubAccounts(s.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, subs)
+}
+
+func (s *Server) handleSubAccountOverview(c *gin.Context) {
+	userID := currentUserID(c)
+	overview, err := engine.GetAccountOverview(s.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, overview)
+}
+
+func (s *Server) setSubAccountFrozen(c *gin.Context, frozen bool) {
+	subID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid sub-account id"})
+		return
+	}
+	userID := currentUserID(c)
+
+	if err := engine.SetSubAccountFrozen(s.db, userID, subID, frozen); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, engine.ErrSubAccountNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": subID, "frozen": frozen})
+}
+
+func (s *Server) handleFreezeSubAccount(c *gin.Context) {
+	s.setSubAccountFrozen(c, true)
+}
+
+func (s *Server) handleUnfreezeSubAccount(c *gin.Context) {
+	s.setSubAccountFrozen(c, false)
+}
+
+func (s *Server) handleSubAccountTransfer(c *gin.Context) {
+	var req subAccountTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	t, err := engine.SubAccountTransfer(s.db, currentUserID(c), req.FromUserID, req.ToUserID, req.Asset, req.Amount, req.IdempotencyKey)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, engine.ErrSubAccountNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, engine.ErrIdempotencyKeyReused):
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// handleCreateSubAccountAPIKey: Key chỉ thao tác được trên đúng một sub-account
+func (s *Server) handleCreateSubAccountAPIKey(c *gin.Context) {
+	subID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid sub-account id"})
+		return
+	}
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := currentUserID(c)
+
+	ok, err := engine.IsSubAccountOf(s.db, userID, subID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok || subID == userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": engine.ErrSubAccountNotFound.Error()})
+		return
+	}
+
+	if !s.checkSecondFactor(c, req.OTP) {
+		return
+	}
+
+	key, secret, err := engine.CreateAPIKey(s.db, userID, subID, req.Label, req.Permissions, req.AllowedIPs)
+	if err != nil {
+		c.JSON(apiKeyErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"key": key, "secret": secret})
+}
+
+func (s *Server) handleListSubAccountAPIKeys(c *gin.Context) {
+	subID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid sub-account id"})
+		return
+	}
+	userID := currentUserID(c)
+
+	ok, err := engine.IsSubAccountOf(s.db, userID, subID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok || subID == userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": engine.ErrSubAccountNotFound.Error()})
+		return
+	}
+
+	keys, err := engine.ListAPIKeys(s.db, subID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"simple-cex/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+type transferRequest struct {
+	ToUserID       int     `json:"to_user_id" binding:"required"`
+	Asset          string  `json:"asset" binding:"required"`
+	Amount         float64 `json:"amount" binding:"required"`
+	IdempotencyKey string  `json:"idempotency_key" binding:"required"`
+	OTP            string  `json:"otp"` // Bắt buộc nếu đã bật 2FA và người nhận nằm ngoài master/sub-account của user
+}
+
+func (s *Server) handleTransfer(c *gin.Context) {
+	var req transferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := currentUserID(c)
+	sameTree, err := engine.SameAccountTree(s.db, userID, req.ToUserID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, engine.ErrUserNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	// Chuyển cho người khác cũng là đưa tiền ra khỏi tài khoản: cần 2FA như POST /withdrawals
+	if !sameTree && !s.checkSecondFactor(c, req.OTP) {
+		return
+	}
+
+	t, err := engine.InternalTransfer(s.db, userID, req.ToUserID, req.Asset, req.Amount, req.IdempotencyKey)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, engine.ErrIdempotencyKeyReused):
+			status = http.StatusConflict
+		case errors.Is(err, engine.ErrAccountFrozen):
+			status = http.StatusForbidden
+		case errors.Is(err, engine.ErrUserNotFound):
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func (s *Server) handleListTransfers(c *gin.Context) {
+	userID := currentUserID(c)
+	transfers, err := engine.ListTransfers(s.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, transfers)
+}
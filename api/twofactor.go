@@ -0,0 +1,82 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"simple-cex/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- 2FA (TOTP) HANDLERS ---
+
+type otpRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func twoFactorErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, engine.ErrOTPRequired), errors.Is(err, engine.ErrInvalidOTP):
+		return http.StatusUnauthorized
+	case errors.Is(err, engine.ErrOTPLocked):
+		return http.StatusTooManyRequests
+	case errors.Is(err, engine.Err2FAAlreadyEnabled):
+		return http.StatusConflict
+	case errors.Is(err, engine.Err2FANotEnabled), errors.Is(err, engine.Err2FASetupNotStarted):
+		return http.StatusBadRequest
+	case errors.Is(err, engine.ErrUserNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// checkSecondFactor: Gọi trước thao tác nhạy cảm, tự trả lỗi và trả về false nếu code không hợp lệ
+func (s *Server) checkSecondFactor(c *gin.Context, code string) bool {
+	if err := engine.VerifySecondFactor(s.db, currentUserID(c), code); err != nil {
+		c.JSON(twoFactorErrorStatus(err), gin.H{
+			"error":        err.Error(),
+			"2fa_required": errors.Is(err, engine.ErrOTPRequired),
+		})
+		return false
+	}
+	return true
+}
+
+// handleSetup2FA: Trả về secret và otpauth URI để quét QR, 2FA chưa có hiệu lực cho tới khi enable
+func (s *Server) handleSetup2FA(c *gin.Context) {
+	setup, err := engine.SetupTOTP(s.db, currentUserID(c))
+	if err != nil {
+		c.JSON(twoFactorErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, setup)
+}
+
+func (s *Server) handleEnable2FA(c *gin.Context) {
+	var req otpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := engine.EnableTOTP(s.db, currentUserID(c), req.Code)
+	if err != nil {
+		c.JSON(twoFactorErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "recovery_codes": codes})
+}
+
+func (s *Server) handleDisable2FA(c *gin.Context) {
+	var req otpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := engine.DisableTOTP(s.db, currentUserID(c), req.Code); err != nil {
+		c.JSON(twoFactorErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": false})
+}
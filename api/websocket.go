@@ -1,83 +1,573 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"simple-cex/engine"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
-// Cấu hình Upgrader: Chuyển từ HTTP thường sang WebSocket
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	// Quan trọng: Cho phép mọi nguồn kết nối (tránh lỗi CORS khi dev)
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+const (
+	// Số tin nhắn tối đa chờ gửi cho một kết nối; đầy nghĩa là client đọc không kịp -> ngắt
+	wsSendQueueSize = 256
+
+	// Thời gian tối đa để ghi một tin nhắn
+	wsWriteWait = 10 * time.Second
+
+	// Không nhận được gì (tin nhắn hoặc pong) trong khoảng này thì coi kết nối đã chết
+	wsIdleTimeout = 60 * time.Second
+
+	// Chu kỳ server gửi ping, phải nhỏ hơn wsIdleTimeout để client kịp trả pong
+	wsPingPeriod = wsIdleTimeout * 9 / 10
+
+	// Kích thước tối đa một tin nhắn client gửi lên (byte)
+	wsMaxMessageSize = 4096
+
+	// Chu kỳ kiểm tra lại session/API key của các kết nối đã xác thực (hết hạn, bị thu hồi ở nơi khác)
+	wsRevalidatePeriod = time.Minute
+)
+
+// DefaultWSAllowedOrigins: Origin được mở /ws từ trình duyệt khi không cấu hình WS_ALLOWED_ORIGINS (frontend khi dev)
+var DefaultWSAllowedOrigins = []string{"http://localhost:5173"}
+
+// wsConn: Một kết nối /ws. Chỉ writePump ghi vào conn; các nơi khác đẩy tin nhắn vào send.
+type wsConn struct {
+	conn *websocket.Conn
+	ip   string
+	send chan []byte   // Hàng đợi gửi có giới hạn
+	done chan struct{} // Đóng khi kết nối bị gỡ khỏi manager
+
+	// Các trường dưới đây được bảo vệ bởi WSManager.mutex
+	userID      int             // != 0 khi đã xác thực
+	apiKey      *engine.APIKey  // != nil khi xác thực bằng API key (giới hạn quyền theo key)
+	token       string          // Session token khi xác thực bằng op "auth", để kiểm tra lại sau handshake
+	topics      map[string]bool // Các topic đang subscribe
+	closeCode   int             // Gửi trong close frame, 0 = không gửi (kết nối đã hỏng)
+	closeReason string
+}
+
+// wsRequest: Tin nhắn client gửi lên, vd {"op": "auth", "token": "<session token>"}
+// hoặc {"op": "subscribe", "id": 1, "topics": ["depth@BTC_USDT", "trades@BTC_USDT"]}
+type wsRequest struct {
+	Op     string          `json:"op"`
+	ID     json.RawMessage `json:"id,omitempty"` // Client tự đặt, gửi lại trong ack/response
+	Token  string          `json:"token"`
+	Topics []string        `json:"topics"`
+	Params json.RawMessage `json:"params"` // Tham số của các op khác (xem Server.handleWSRequest)
+}
+
+// wsCaller: Danh tính của kết nối tại thời điểm gửi request
+type wsCaller struct {
+	userID int // 0 = chưa xác thực
+	apiKey *engine.APIKey
+	token  string // Session token, rỗng khi xác thực bằng API key
+	ip     string
 }
 
-// WSManager quản lý các kết nối
+// Các loại topic công khai (<stream>@<SYMBOL>, riêng ticker dùng ticker@all)
+const (
+	topicDepth  = "depth"
+	topicTrades = "trades"
+	topicTicker = "ticker"
+	topicKline  = "kline_" // kline_<interval>, interval thuộc engine.CandleIntervals
+)
+
+// MaxWSSubscriptions: Số topic tối đa trên một kết nối
+const MaxWSSubscriptions = 50
+
+var errTooManySubscriptions = errors.New("too many subscriptions on this connection")
+
+func depthTopic(symbol string) string           { return topicDepth + "@" + symbol }
+func tradesTopic(symbol string) string          { return topicTrades + "@" + symbol }
+func klineTopic(interval, symbol string) string { return topicKline + interval + "@" + symbol }
+
+const tickerAllTopic = topicTicker + "@all"
+
+// WSManager quản lý các kết nối.
+// Publish/SendToUser chỉ đẩy vào hàng đợi của từng kết nối (không chặn), mỗi kết nối có goroutine ghi riêng.
 type WSManager struct {
-	clients    map[*websocket.Conn]bool // Danh sách user đang kết nối
-	broadcast  chan interface{}         // Kênh nhận dữ liệu để bắn đi
-	register   chan *websocket.Conn     // Kênh đăng ký user mới
-	unregister chan *websocket.Conn     // Kênh hủy đăng ký user
-	mutex      sync.Mutex
+	mutex          sync.Mutex
+	clients        map[*wsConn]bool
+	users          map[int]map[*wsConn]bool    // userID -> các kết nối đã xác thực
+	topics         map[string]map[*wsConn]bool // topic -> các kết nối đã subscribe
+	ipConns        *connLimiter                // Giới hạn số kết nối mỗi IP
+	upgrader       websocket.Upgrader
+	allowedOrigins []string // Xem SetAllowedOrigins
+
+	authenticate func(token string) (int, error) // Xác thực session token -> userID
+	hasSymbol    func(symbol string) bool        // Kiểm tra symbol trong topic
+
+	// onRequest xử lý các op ngoài auth/subscribe, handled = false nghĩa là op không tồn tại. Xem SetRequestHandler.
+	onRequest func(caller wsCaller, req wsRequest) (resp gin.H, handled bool)
+
+	// checkCaller kiểm tra lại session/API key của kết nối. Xem SetCredentialCheck.
+	checkCaller func(caller wsCaller) error
 }
 
-func NewWSManager() *WSManager {
-	return &WSManager{
-		clients:    make(map[*websocket.Conn]bool),
-		broadcast:  make(chan interface{}),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
+func NewWSManager(authenticate func(token string) (int, error), hasSymbol func(symbol string) bool) *WSManager {
+	manager := &WSManager{
+		clients:        make(map[*wsConn]bool),
+		users:          make(map[int]map[*wsConn]bool),
+		topics:         make(map[string]map[*wsConn]bool),
+		ipConns:        newConnLimiter(MaxWSConnectionsPerIP),
+		allowedOrigins: DefaultWSAllowedOrigins,
+		authenticate:   authenticate,
+		hasSymbol:      hasSymbol,
+	}
+	// Cấu hình Upgrader: Chuyển từ HTTP thường sang WebSocket
+	manager.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     manager.checkOrigin,
 	}
+	return manager
 }
 
-// Run: Vòng lặp chính để xử lý tin nhắn
-func (manager *WSManager) Run() {
-	for {
-		select {
-		case conn := <-manager.register:
-			manager.mutex.Lock()
-			manager.clients[conn] = true
-			manager.mutex.Unlock()
-			log.Println("New client connected")
+// SetRequestHandler: Chỉ gọi lúc khởi động
+func (manager *WSManager) SetRequestHandler(fn func(caller wsCaller, req wsRequest) (gin.H, bool)) {
+	manager.onRequest = fn
+}
 
-		case conn := <-manager.unregister:
-			manager.mutex.Lock()
-			if _, ok := manager.clients[conn]; ok {
-				delete(manager.clients, conn)
-				conn.Close()
+// SetCredentialCheck: Hàm kiểm tra lại danh tính cho RunRevalidation. Chỉ gọi lúc khởi động.
+func (manager *WSManager) SetCredentialCheck(fn func(caller wsCaller) error) {
+	manager.checkCaller = fn
+}
+
+// SetAllowedOrigins: Các Origin (vd "https://exchange.example.com") được mở /ws từ trình duyệt, "*" cho phép mọi nguồn.
+// Chỉ gọi lúc khởi động.
+func (manager *WSManager) SetAllowedOrigins(origins []string) {
+	manager.allowedOrigins = make([]string, 0, len(origins))
+	for _, o := range origins {
+		if o = strings.TrimSpace(o); o != "" {
+			manager.allowedOrigins = append(manager.allowedOrigins, o)
+		}
+	}
+}
+
+// checkOrigin: Cho phép client không gửi Origin (bot, không phải trình duyệt), cùng host với server,
+// hoặc Origin nằm trong danh sách cho phép
+func (manager *WSManager) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range manager.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	log.Printf("WS: rejected origin %q", origin)
+	return false
+}
+
+// Publish: Gửi tin nhắn công khai cho các kết nối đã subscribe topic
+func (manager *WSManager) Publish(topic string, msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("WS Publish %s: %v", topic, err)
+		return
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	for c := range manager.topics[topic] {
+		manager.enqueueLocked(c, data)
+	}
+}
+
+// SendToUser: Gửi tin nhắn riêng tới mọi kết nối đã xác thực của user
+func (manager *WSManager) SendToUser(userID int, msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("WS SendToUser %d: %v", userID, err)
+		return
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	for c := range manager.users[userID] {
+		manager.enqueueLocked(c, data)
+	}
+}
+
+// CloseSession: Ngắt các kết nối đã xác thực bằng session token (sau khi logout)
+func (manager *WSManager) CloseSession(token string) {
+	if token == "" {
+		return
+	}
+	manager.closeWhere(func(c *wsConn) bool { return c.token == token })
+}
+
+// CloseAPIKey: Ngắt các kết nối đã xác thực bằng API key (sau khi thu hồi key)
+func (manager *WSManager) CloseAPIKey(keyID int) {
+	manager.closeWhere(func(c *wsConn) bool { return c.apiKey != nil && c.apiKey.ID == keyID })
+}
+
+func (manager *WSManager) closeWhere(match func(c *wsConn) bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	for c := range manager.clients {
+		if c.userID != 0 && match(c) {
+			manager.removeLocked(c, websocket.ClosePolicyViolation, "credentials revoked")
+		}
+	}
+}
+
+// RunRevalidation: Định kỳ kiểm tra lại danh tính của mọi kết nối đã xác thực, ngắt các kết nối có
+// session hết hạn/bị thu hồi hoặc API key bị thu hồi để stream riêng không tiếp tục chạy.
+func (manager *WSManager) RunRevalidation() {
+	ticker := time.NewTicker(wsRevalidatePeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		manager.revalidate()
+	}
+}
+
+func (manager *WSManager) revalidate() {
+	if manager.checkCaller == nil {
+		return
+	}
+	manager.mutex.Lock()
+	callers := make(map[*wsConn]wsCaller)
+	for c := range manager.clients {
+		if c.userID != 0 {
+			callers[c] = wsCaller{userID: c.userID, apiKey: c.apiKey, token: c.token, ip: c.ip}
+		}
+	}
+	manager.mutex.Unlock()
+
+	// Kiểm tra ngoài mutex vì mỗi lần là một truy vấn DB
+	for c, caller := range callers {
+		err := manager.checkCaller(caller)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, engine.ErrInvalidSession) && !errors.Is(err, engine.ErrInvalidAPIKey) {
+			log.Printf("WS revalidate user %d: %v", caller.userID, err) // Lỗi DB: giữ kết nối, thử lại lần sau
+			continue
+		}
+		manager.mutex.Lock()
+		if c.userID == caller.userID && c.token == caller.token && c.apiKey == caller.apiKey {
+			manager.removeLocked(c, websocket.ClosePolicyViolation, "credentials revoked")
+		}
+		manager.mutex.Unlock()
+	}
+}
+
+// reply: Gửi phản hồi cho một kết nối
+func (manager *WSManager) reply(c *wsConn, msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("WS reply: %v", err)
+		return
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.clients[c] {
+		manager.enqueueLocked(c, data)
+	}
+}
+
+// enqueueLocked đẩy tin nhắn vào hàng đợi; hàng đợi đầy thì ngắt kết nối thay vì chờ (caller giữ mutex)
+func (manager *WSManager) enqueueLocked(c *wsConn, data []byte) {
+	select {
+	case c.send <- data:
+	default:
+		log.Printf("WS: dropping slow client %s (send queue full)", c.ip)
+		manager.removeLocked(c, websocket.ClosePolicyViolation, "slow consumer: send queue full")
+	}
+}
+
+func (manager *WSManager) add(c *wsConn) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.clients[c] = true
+	if c.userID != 0 {
+		manager.bindLocked(c, c.userID, c.apiKey, "")
+	}
+	log.Println("New client connected")
+}
+
+func (manager *WSManager) remove(c *wsConn, code int, reason string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.removeLocked(c, code, reason)
+}
+
+// removeLocked gỡ kết nối, báo writePump gửi close frame rồi đóng, trả lại slot của IP (caller giữ mutex)
+func (manager *WSManager) removeLocked(c *wsConn, code int, reason string) {
+	if !manager.clients[c] {
+		return
+	}
+	delete(manager.clients, c)
+	manager.unbindLocked(c)
+	for t := range c.topics {
+		manager.unsubscribeLocked(c, t)
+	}
+	c.closeCode, c.closeReason = code, reason
+	close(c.done)
+	manager.ipConns.release(c.ip)
+	log.Println("Client disconnected")
+}
+
+// bindLocked gắn kết nối với user để nhận tin nhắn riêng (caller giữ mutex)
+func (manager *WSManager) bindLocked(c *wsConn, userID int, apiKey *engine.APIKey, token string) {
+	manager.unbindLocked(c)
+	if manager.users[userID] == nil {
+		manager.users[userID] = make(map[*wsConn]bool)
+	}
+	manager.users[userID][c] = true
+	c.userID = userID
+	c.apiKey = apiKey
+	c.token = token
+}
+
+// unbindLocked gỡ kết nối khỏi user đã xác thực trước đó (nếu có)
+func (manager *WSManager) unbindLocked(c *wsConn) {
+	if c.userID == 0 {
+		return
+	}
+	delete(manager.users[c.userID], c)
+	if len(manager.users[c.userID]) == 0 {
+		delete(manager.users, c.userID)
+	}
+	c.userID = 0
+	c.apiKey = nil
+	c.token = ""
+}
+
+// applySubscriptionLocked cập nhật topic của kết nối và trả về ack (caller giữ mutex)
+func (manager *WSManager) applySubscriptionLocked(c *wsConn, req wsRequest) gin.H {
+	subscribe := req.Op == "subscribe"
+	ackType := "UNSUBSCRIBED"
+	if subscribe {
+		ackType = "SUBSCRIBED"
+		current := len(c.topics)
+		for _, t := range req.Topics {
+			if !c.topics[t] {
+				current++
 			}
-			manager.mutex.Unlock()
-			log.Println("Client disconnected")
+		}
+		if current > MaxWSSubscriptions {
+			return gin.H{"type": "ERROR", "id": req.ID, "error": errTooManySubscriptions.Error()}
+		}
+	}
 
-		case message := <-manager.broadcast:
-			// Nhận được tin nhắn -> Gửi cho TOÀN BỘ clients
-			manager.mutex.Lock()
-			for conn := range manager.clients {
-				err := conn.WriteJSON(message)
-				if err != nil {
-					log.Printf("WS Error: %v", err)
-					conn.Close()
-					delete(manager.clients, conn)
-				}
+	for _, t := range req.Topics {
+		if subscribe {
+			if manager.topics[t] == nil {
+				manager.topics[t] = make(map[*wsConn]bool)
 			}
-			manager.mutex.Unlock()
+			manager.topics[t][c] = true
+			c.topics[t] = true
+		} else {
+			manager.unsubscribeLocked(c, t)
 		}
 	}
+
+	active := make([]string, 0, len(c.topics))
+	for t := range c.topics {
+		active = append(active, t)
+	}
+	return gin.H{"type": ackType, "id": req.ID, "topics": req.Topics, "subscriptions": active}
 }
 
-// Handler để Gin gọi vào khi có request /ws
-func (manager *WSManager) ServeWS(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+func (manager *WSManager) unsubscribeLocked(c *wsConn, topic string) {
+	delete(manager.topics[topic], c)
+	if len(manager.topics[topic]) == 0 {
+		delete(manager.topics, topic)
+	}
+	delete(c.topics, topic)
+}
+
+// ServeWS: Upgrade kết nối. apiKey != nil khi request upgrade đã được ký bằng API key (xem handleWS).
+func (manager *WSManager) ServeWS(c *gin.Context, apiKey *engine.APIKey) {
+	ip := c.ClientIP()
+	if !manager.ipConns.acquire(ip) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many websocket connections from this ip"})
+		return
+	}
+
+	conn, err := manager.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
+		manager.ipConns.release(ip)
 		log.Println("Upgrade failed:", err)
 		return
 	}
-	manager.register <- conn
-}
\ No newline at end of file
+
+	client := &wsConn{
+		conn:   conn,
+		ip:     ip,
+		send:   make(chan []byte, wsSendQueueSize),
+		done:   make(chan struct{}),
+		topics: make(map[string]bool),
+	}
+	if apiKey != nil {
+		client.userID, client.apiKey = apiKey.UserID, apiKey
+	}
+	manager.add(client)
+	go manager.writePump(client)
+	if apiKey != nil {
+		manager.reply(client, gin.H{"type": "AUTH", "success": true, "user_id": apiKey.UserID})
+	}
+
+	go manager.readPump(client)
+}
+
+// readPump: Goroutine duy nhất đọc từ conn. Mọi frame nhận được (kể cả pong) gia hạn idle timeout.
+func (manager *WSManager) readPump(c *wsConn) {
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			code, reason := readCloseReason(err)
+			manager.remove(c, code, reason)
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		manager.handleMessage(c, data)
+	}
+}
+
+// readCloseReason: Close frame trả lời khi vòng đọc dừng vì lỗi err
+func readCloseReason(err error) (int, string) {
+	var netErr net.Error
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+		return 0, "" // Client chủ động đóng, gorilla đã trả close frame
+	case errors.Is(err, websocket.ErrReadLimit):
+		return websocket.CloseMessageTooBig, "message too big"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return websocket.CloseGoingAway, "idle timeout"
+	}
+	return 0, "" // Kết nối đã hỏng, không gửi close frame
+}
+
+// writePump: Goroutine duy nhất ghi vào conn, gửi ping định kỳ.
+// Khi kết nối bị gỡ thì gửi close frame kèm lý do rồi đóng.
+func (manager *WSManager) writePump(c *wsConn) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("WS Error: %v", err)
+				manager.remove(c, 0, "")
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				manager.remove(c, 0, "")
+				return
+			}
+		case <-c.done:
+			if c.closeCode != 0 {
+				msg := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+			}
+			return
+		}
+	}
+}
+
+// handleMessage: Xử lý một tin nhắn client gửi lên
+func (manager *WSManager) handleMessage(c *wsConn, data []byte) {
+	var req wsRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		manager.reply(c, gin.H{"type": "ERROR", "error": "invalid message"})
+		return
+	}
+
+	switch req.Op {
+	case "auth":
+		userID, err := manager.authenticate(req.Token)
+		if err != nil {
+			manager.reply(c, gin.H{"type": "AUTH", "success": false, "error": err.Error()})
+			return
+		}
+		manager.mutex.Lock()
+		if manager.clients[c] {
+			manager.bindLocked(c, userID, nil, req.Token)
+		}
+		manager.mutex.Unlock()
+		manager.reply(c, gin.H{"type": "AUTH", "success": true, "user_id": userID})
+	case "subscribe", "unsubscribe":
+		if len(req.Topics) == 0 {
+			manager.reply(c, gin.H{"type": "ERROR", "id": req.ID, "error": "topics is required"})
+			return
+		}
+		for _, t := range req.Topics {
+			if err := manager.validateTopic(t); err != nil {
+				manager.reply(c, gin.H{"type": "ERROR", "id": req.ID, "error": err.Error()})
+				return
+			}
+		}
+		// Áp dụng và xếp ack vào hàng đợi trong cùng một lần giữ mutex,
+		// nên ack luôn đi trước tin nhắn đầu tiên của topic vừa subscribe
+		manager.mutex.Lock()
+		if manager.clients[c] {
+			if ack, err := json.Marshal(manager.applySubscriptionLocked(c, req)); err == nil {
+				manager.enqueueLocked(c, ack)
+			}
+		}
+		manager.mutex.Unlock()
+	default:
+		if manager.onRequest != nil {
+			manager.mutex.Lock()
+			caller := wsCaller{userID: c.userID, apiKey: c.apiKey, token: c.token, ip: c.ip}
+			manager.mutex.Unlock()
+			if resp, handled := manager.onRequest(caller, req); handled {
+				manager.reply(c, resp)
+				return
+			}
+		}
+		manager.reply(c, gin.H{"type": "ERROR", "id": req.ID, "error": "unknown op: " + req.Op})
+	}
+}
+
+// validateTopic: depth@<SYMBOL>, trades@<SYMBOL>, kline_<interval>@<SYMBOL> hoặc ticker@all
+func (manager *WSManager) validateTopic(topic string) error {
+	stream, symbol, ok := strings.Cut(topic, "@")
+	if !ok {
+		return errors.New("invalid topic: " + topic)
+	}
+	if stream == topicTicker {
+		if symbol != "all" {
+			return errors.New("invalid topic: " + topic + " (use ticker@all)")
+		}
+		return nil
+	}
+
+	switch {
+	case stream == topicDepth, stream == topicTrades:
+	case strings.HasPrefix(stream, topicKline) && slices.Contains(engine.CandleIntervals, strings.TrimPrefix(stream, topicKline)):
+	default:
+		return errors.New("invalid topic: " + topic)
+	}
+	if !manager.hasSymbol(symbol) {
+		return errors.New("unknown symbol in topic: " + topic)
+	}
+	return nil
+}
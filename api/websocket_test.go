@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"simple-cex/engine"
+	"testing"
+)
+
+// newBoundConn: Kết nối giả (không có socket) đã xác thực, đủ để thử bind/remove của WSManager
+func newBoundConn(m *WSManager, userID int, apiKey *engine.APIKey, token string) *wsConn {
+	c := &wsConn{
+		ip:     "10.0.0.1",
+		send:   make(chan []byte, wsSendQueueSize),
+		done:   make(chan struct{}),
+		topics: make(map[string]bool),
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.clients[c] = true
+	m.bindLocked(c, userID, apiKey, token)
+	return c
+}
+
+func isClosed(c *wsConn) bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Logout và thu hồi API key phải ngắt đúng các kết nối dùng danh tính đó
+func TestWSCloseRevokedCredentials(t *testing.T) {
+	m := NewWSManager(nil, nil)
+	key := &engine.APIKey{ID: 7, UserID: 1}
+	session := newBoundConn(m, 1, nil, "token-a")
+	otherSession := newBoundConn(m, 1, nil, "token-b")
+	withKey := newBoundConn(m, 1, key, "")
+
+	m.CloseSession("token-a")
+	if !isClosed(session) || isClosed(otherSession) || isClosed(withKey) {
+		t.Fatal("CloseSession must only close connections using that token")
+	}
+
+	m.CloseAPIKey(7)
+	if !isClosed(withKey) || isClosed(otherSession) {
+		t.Fatal("CloseAPIKey must only close connections using that key")
+	}
+	if withKey.closeReason != "credentials revoked" {
+		t.Errorf("close reason = %q", withKey.closeReason)
+	}
+	if len(m.users[1]) != 1 {
+		t.Errorf("user 1 has %d bound connections, want 1", len(m.users[1]))
+	}
+}
+
+// Kiểm tra định kỳ: ngắt khi danh tính không còn hiệu lực, giữ kết nối khi lỗi tạm thời (DB)
+func TestWSRevalidate(t *testing.T) {
+	m := NewWSManager(nil, nil)
+	revoked := newBoundConn(m, 1, nil, "revoked")
+	valid := newBoundConn(m, 2, nil, "valid")
+	dbDown := newBoundConn(m, 3, &engine.APIKey{ID: 9, UserID: 3}, "")
+	m.SetCredentialCheck(func(caller wsCaller) error {
+		switch {
+		case caller.token == "revoked":
+			return engine.ErrInvalidSession
+		case caller.apiKey != nil:
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	m.revalidate()
+	if !isClosed(revoked) {
+		t.Error("connection with a revoked session was not closed")
+	}
+	if isClosed(valid) || isClosed(dbDown) {
+		t.Error("connection closed without its credentials being revoked")
+	}
+}
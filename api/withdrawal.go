@@ -0,0 +1,214 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"simple-cex/engine"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- WITHDRAWAL HANDLERS ---
+
+type addWithdrawalAddressRequest struct {
+	Asset   string `json:"asset" binding:"required"`
+	Address string `json:"address" binding:"required"`
+	Label   string `json:"label"`
+}
+
+type withdrawRequest struct {
+	Asset   string  `json:"asset" binding:"required"`
+	Address string  `json:"address" binding:"required"`
+	Amount  float64 `json:"amount" binding:"required"`
+	OTP     string  `json:"otp"` // Bắt buộc nếu user đã bật 2FA
+}
+
+type reviewWithdrawalRequest struct {
+	Note string `json:"note"`
+}
+
+type completeWithdrawalRequest struct {
+	TxHash string `json:"tx_hash" binding:"required"`
+}
+
+// withdrawalErrorStatus: Lỗi nghiệp vụ -> 4xx, còn lại là lỗi hệ thống -> 500
+func withdrawalErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, engine.ErrWithdrawalNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, engine.ErrWithdrawalInvalidState):
+		return http.StatusConflict
+	case errors.Is(err, engine.ErrAccountFrozen):
+		return http.StatusForbidden
+	case errors.Is(err, engine.ErrInsufficientBalance),
+		errors.Is(err, engine.ErrAddressNotWhitelisted),
+		errors.Is(err, engine.ErrAddressCoolingOff),
+		errors.Is(err, engine.ErrDailyLimitExceeded):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) handleAddWithdrawalAddress(c *gin.Context) {
+	var req addWithdrawalAddressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	addr, err := engine.AddWithdrawalAddress(s.db, currentUserID(c), req.Asset, req.Address, req.Label)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, addr)
+}
+
+func (s *Server) handleListWithdrawalAddresses(c *gin.Context) {
+	userID := currentUserID(c)
+	addresses, err := engine.ListWithdrawalAddresses(s.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, addresses)
+}
+
+func (s *Server) handleRemoveWithdrawalAddress(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid address id"})
+		return
+	}
+	userID := currentUserID(c)
+
+	if err := engine.RemoveWithdrawalAddress(s.db, userID, id); err != nil {
+		c.JSON(withdrawalErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Address removed"})
+}
+
+func (s *Server) handleGetWithdrawalLimit(c *gin.Context) {
+	userID := currentUserID(c)
+	limit, err := engine.GetWithdrawalLimit(s.db, userID, c.Query("asset"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, limit)
+}
+
+func (s *Server) handleWithdraw(c *gin.Context) {
+	var req withdrawRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !s.checkSecondFactor(c, req.OTP) {
+		return
+	}
+
+	w, err := engine.RequestWithdrawal(s.db, currentUserID(c), req.Asset, req.Address, req.Amount)
+	if err != nil {
+		c.JSON(withdrawalErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, w)
+}
+
+func (s *Server) handleListWithdrawals(c *gin.Context) {
+	userID := currentUserID(c)
+	withdrawals, err := engine.ListWithdrawals(s.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, withdrawals)
+}
+
+func (s *Server) handleCancelWithdrawal(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid withdrawal id"})
+		return
+	}
+	userID := currentUserID(c)
+
+	if err := engine.CancelWithdrawal(s.db, userID, id); err != nil {
+		c.JSON(withdrawalErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Withdrawal cancelled"})
+}
+
+// --- ADMIN: Hàng đợi duyệt lệnh rút ---
+
+func (s *Server) handleAdminListWithdrawals(c *gin.Context) {
+	status := c.DefaultQuery("status", engine.WithdrawalPendingReview)
+	withdrawals, err := engine.ListWithdrawalsByStatus(s.db, status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, withdrawals)
+}
+
+func (s *Server) handleAdminApproveWithdrawal(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid withdrawal id"})
+		return
+	}
+	var req reviewWithdrawalRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := engine.ApproveWithdrawal(s.db, id, currentUserID(c), req.Note); err != nil {
+		c.JSON(withdrawalErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Withdrawal approved"})
+}
+
+func (s *Server) handleAdminRejectWithdrawal(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid withdrawal id"})
+		return
+	}
+	var req reviewWithdrawalRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := engine.RejectWithdrawal(s.db, id, currentUserID(c), req.Note); err != nil {
+		c.JSON(withdrawalErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Withdrawal rejected"})
+}
+
+func (s *Server) handleAdminCompleteWithdrawal(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid withdrawal id"})
+		return
+	}
+	var req completeWithdrawalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := engine.CompleteWithdrawal(s.db, id, req.TxHash); err != nil {
+		c.JSON(withdrawalErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Withdrawal completed"})
+}
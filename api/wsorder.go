@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"simple-cex/engine"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- ORDER ENTRY QUA WEBSOCKET ---
+// Request: {"op": "place_order", "id": "r1", "params": {...}} trên kết nối đã xác thực.
+// Response: {"type": "RESPONSE", "id": "r1", "op": "place_order", "status": 200, "result": {...}}
+// (lỗi thì có "error" thay cho "result"). result giống hệt payload của API REST tương ứng.
+
+// wsOrderIDParams: Chọn lệnh theo order_id hoặc client_order_id
+type wsOrderIDParams struct {
+	OrderID       int    `json:"order_id"`
+	ClientOrderID string `json:"client_order_id"`
+}
+
+type wsAmendParams struct {
+	OrderID int `json:"order_id"`
+	amendOrderRequest
+}
+
+type wsCancelAllParams struct {
+	Symbol string `json:"symbol"`
+}
+
+// wsOrderOps: Các op đặt/huỷ lệnh, value = có tính vào giới hạn đặt lệnh hay không
+var wsOrderOps = map[string]bool{
+	"place_order":  true,
+	"amend_order":  true,
+	"cancel_order": false,
+	"cancel_all":   false,
+}
+
+// checkWSCredentials: Danh tính của kết nối còn hiệu lực không; trả về bản mới nhất của API key (nếu dùng key)
+func (s *Server) checkWSCredentials(caller wsCaller) (*engine.APIKey, error) {
+	if caller.apiKey != nil {
+		key, _, err := engine.LookupAPIKey(s.db, caller.apiKey.APIKey)
+		if err != nil {
+			return nil, err
+		}
+		if key.UserID != caller.userID || !key.AllowsIP(caller.ip) {
+			return nil, engine.ErrInvalidAPIKey
+		}
+		return key, nil
+	}
+	userID, err := engine.Authenticate(s.db, caller.token)
+	if err != nil {
+		return nil, err
+	}
+	if userID != caller.userID {
+		return nil, engine.ErrInvalidSession
+	}
+	return nil, nil
+}
+
+// handleWSRequest: Cùng quy tắc với REST: cần đăng nhập, API key cần quyền trade,
+// mỗi request trừ 1 điểm rate limit theo IP, đặt/sửa lệnh tính vào giới hạn đặt lệnh của user.
+func (s *Server) handleWSRequest(caller wsCaller, req wsRequest) (gin.H, bool) {
+	countsAsOrder, ok := wsOrderOps[req.Op]
+	if !ok {
+		return nil, false
+	}
+
+	resp := gin.H{"type": "RESPONSE", "id": req.ID, "op": req.Op}
+	fail := func(status int, err error) (gin.H, bool) {
+		resp["status"] = status
+		resp["error"] = err.Error()
+		return resp, true
+	}
+
+	if caller.userID == 0 {
+		return fail(http.StatusUnauthorized, errors.New("authentication required"))
+	}
+	// Session/API key chỉ được kiểm tra lúc handshake: kiểm tra lại để logout hay thu hồi key có hiệu lực ngay
+	key, err := s.checkWSCredentials(caller)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, engine.ErrInvalidSession) || errors.Is(err, engine.ErrInvalidAPIKey) {
+			status = http.StatusUnauthorized
+		}
+		return fail(status, err)
+	}
+	if key != nil && !key.HasPermission(engine.PermTrade) {
+		return fail(http.StatusForbidden, errors.New("api key lacks permission: "+engine.PermTrade))
+	}
+	if res := s.ipLimiter.take(caller.ip, 1, time.Now()); !res.allowed {
+		resp["retry_after_ms"] = res.retryAfter.Milliseconds()
+		return fail(http.StatusTooManyRequests, errors.New("request weight limit exceeded"))
+	}
+	if countsAsOrder {
+		if res, msg := s.allowOrder(caller.userID); !res.allowed {
+			resp["retry_after_ms"] = res.retryAfter.Milliseconds()
+			return fail(http.StatusTooManyRequests, errors.New(msg))
+		}
+	}
+
+	result, err := s.dispatchWSOrderOp(caller.userID, req)
+	if err != nil {
+		status := orderErrorStatus(err)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, errMissingOrderID) {
+			status = http.StatusBadRequest
+		}
+		if amended, ok := result.(*engine.AmendResult); ok && amended != nil {
+			resp["result"] = amended // Sửa lệnh: lệnh cũ đã huỷ nhưng đặt lệnh thay thế lỗi
+		}
+		return fail(status, err)
+	}
+	resp["status"] = http.StatusOK
+	resp["result"] = result
+	return resp, true
+}
+
+var errMissingOrderID = errors.New("order_id or client_order_id is required")
+
+func (s *Server) dispatchWSOrderOp(userID int, req wsRequest) (interface{}, error) {
+	params := req.Params
+	if len(params) == 0 {
+		params = json.RawMessage("{}")
+	}
+
+	switch req.Op {
+	case "place_order":
+		var p placeOrderRequest
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		return s.placeOrder(userID, p)
+
+	case "cancel_order":
+		var p wsOrderIDParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		switch {
+		case p.OrderID != 0:
+			return s.engine.CancelOrder(userID, p.OrderID)
+		case p.ClientOrderID != "":
+			return s.engine.CancelOrderByClientID(userID, p.ClientOrderID)
+		}
+		return nil, errMissingOrderID
+
+	case "amend_order":
+		var p wsAmendParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		if p.OrderID == 0 {
+			return nil, errMissingOrderID
+		}
+		return s.amendOrder(userID, p.OrderID, p.amendOrderRequest)
+
+	case "cancel_all":
+		var p wsCancelAllParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		return s.engine.CancelAllOrders(userID, strings.ToUpper(p.Symbol))
+	}
+	return nil, errors.New("unknown op: " + req.Op)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"log"
+	"os"
 	"simple-cex/api"    // Import package api
 	"simple-cex/engine" // Import package engine
+	"strings"
 )
 
 func main() {
@@ -16,9 +18,37 @@ func main() {
 
 	// 2. Khởi tạo Engine (Core Logic)
 	tradeEngine := engine.NewEngine(db)
+	// Dựng nến cho các trade từ trước khi có bảng candles (trade mới được gộp vào nến ngay lúc settle)
+	if err := tradeEngine.BackfillCandles(); err != nil {
+		log.Printf("Cannot backfill candles: %v", err)
+	}
+
+	// Tài khoản (đã đăng ký) được cấp admin khi hệ thống còn ít hơn hai admin: cần admin thứ hai
+	// để duyệt việc cấp admin và điều chỉnh số dư. Đủ hai admin rồi thì biến này không còn tác dụng.
+	if email := os.Getenv("BOOTSTRAP_ADMIN_EMAIL"); email != "" {
+		if err := engine.BootstrapAdmin(db, email); err != nil {
+			log.Printf("Cannot bootstrap admin %s: %v", email, err)
+		}
+	}
 
-	// 3. Khởi tạo API Server (Lớp giao tiếp)
+	// 3. Khởi tạo API Server (Lớp giao tiếp). NewServer đăng ký các handler sự kiện của engine,
+	// phải chạy trước các worker để không race trên danh sách handler và không mất sự kiện lúc khởi động.
 	server := api.NewServer(tradeEngine, db)
+	go tradeEngine.RunSettlementWorker()
+	go tradeEngine.RunCandleTicker()
+	go server.RunWSRevalidation()
+
+	// IP/CIDR của reverse proxy phía trước (nếu có), cách nhau bởi dấu phẩy. Không đặt = không tin X-Forwarded-For
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		if err := server.SetTrustedProxies(strings.Split(proxies, ",")); err != nil {
+			log.Fatal("Invalid TRUSTED_PROXIES:", err)
+		}
+	}
+
+	// Origin được phép mở /ws từ trình duyệt, cách nhau bởi dấu phẩy ("*" = mọi nguồn)
+	if origins := os.Getenv("WS_ALLOWED_ORIGINS"); origins != "" {
+		server.SetWSAllowedOrigins(strings.Split(origins, ","))
+	}
 
 	// 4. Chạy Server tại port 8010
 	log.Println("Starting server on 0.0.0.0:8010")
@@ -0,0 +1,190 @@
+package main
+
+// Benchmark settlement: so sánh cách settle cũ (mỗi trade ~8 round trip)
+// với SettleTrades (gộp số dư, set-based, một pgx.Batch).
+// Mọi thay đổi đều chạy trong transaction và bị ROLLBACK -> không làm bẩn DB.
+//
+//	cd benchmark && go run main.go -trades 200 -rounds 20
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"simple-cex/engine"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const SYMBOL = "BTC_USDT"
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func main() {
+	tradesPerRound := flag.Int("trades", 200, "số trades mỗi lần settle")
+	rounds := flag.Int("rounds", 20, "số lần settle cho mỗi cách")
+	numUsers := flag.Int("users", 10, "số user tham gia (dùng user 1..N trong seed)")
+	flag.Parse()
+
+	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s",
+		getenv("DB_USER", "cex"), getenv("DB_PASSWORD", "cexpass"),
+		getenv("DB_HOST", "localhost"), getenv("DB_PORT", "5432"), getenv("DB_NAME", "cexdb"))
+	db, err := pgxpool.New(context.Background(), connStr)
+	if err != nil {
+		log.Fatal("Cannot connect to DB:", err)
+	}
+	defer db.Close()
+
+	fmt.Printf("Settlement benchmark: %d rounds x %d trades, %d users\n", *rounds, *tradesPerRound, *numUsers)
+
+	legacy := run(db, *rounds, *tradesPerRound, *numUsers, settleLegacy)
+	batch := run(db, *rounds, *tradesPerRound, *numUsers, engine.SettleTrades)
+
+	total := float64(*rounds * *tradesPerRound)
+	fmt.Printf("legacy (per-trade):  %8d trades in %-12s -> %10.0f trades/sec\n", int(total), legacy.Round(time.Millisecond), total/legacy.Seconds())
+	fmt.Printf("batch (set-based):   %8d trades in %-12s -> %10.0f trades/sec\n", int(total), batch.Round(time.Millisecond), total/batch.Seconds())
+	fmt.Printf("speedup: %.1fx\n", legacy.Seconds()/batch.Seconds())
+}
+
+type settleFunc func(ctx context.Context, tx pgx.Tx, trades []engine.Trade) error
+
+// run: Mỗi round tạo orders giả trong transaction, chỉ đo thời gian settle, rồi rollback
+func run(db *pgxpool.Pool, rounds, n, numUsers int, settle settleFunc) time.Duration {
+	ctx := context.Background()
+	var elapsed time.Duration
+
+	for r := 0; r < rounds; r++ {
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		trades := prepareTrades(ctx, tx, n, numUsers)
+
+		start := time.Now()
+		if err := settle(ctx, tx, trades); err != nil {
+			log.Fatal("settle failed: ", err)
+		}
+		elapsed += time.Since(start)
+
+		tx.Rollback(ctx)
+	}
+	return elapsed
+}
+
+// prepareTrades: Tạo cặp lệnh maker/taker đã lock tiền sẵn và trades tương ứng
+func prepareTrades(ctx context.Context, tx pgx.Tx, n, numUsers int) []engine.Trade {
+	// Đủ locked để settlement không vi phạm CHECK (locked >= 0)
+	_, err := tx.Exec(ctx,
+		`UPDATE balances SET locked = locked + 1000000000 WHERE user_id BETWEEN 1 AND $1`,
+		numUsers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	trades := make([]engine.Trade, n)
+	for i := range trades {
+		makerUser := 1 + rand.Intn(numUsers)
+		takerUser := 1 + rand.Intn(numUsers)
+		takerSide, makerSide := "BUY", "SELL"
+		if rand.Intn(2) == 0 {
+			takerSide, makerSide = "SELL", "BUY"
+		}
+		price := 49000 + rand.Float64()*2000
+		amount := 0.01 + rand.Float64()
+
+		var makerID, takerID int
+		err := tx.QueryRow(ctx,
+			`INSERT INTO orders (user_id, symbol, side, price, amount) VALUES ($1,$2,$3,$4,$5) RETURNING id`,
+			makerUser, SYMBOL, makerSide, price, amount).Scan(&makerID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = tx.QueryRow(ctx,
+			`INSERT INTO orders (user_id, symbol, side, price, amount) VALUES ($1,$2,$3,$4,$5) RETURNING id`,
+			takerUser, SYMBOL, takerSide, price, amount).Scan(&takerID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		trades[i] = engine.Trade{
+			Symbol:       SYMBOL,
+			MakerOrderID: makerID,
+			TakerOrderID: takerID,
+			MakerUserID:  makerUser,
+			TakerUserID:  takerUser,
+			TakerSide:    takerSide,
+			TakerPrice:   price,
+			Price:        price,
+			Amount:       amount,
+			CreatedAt:    time.Now(),
+		}
+	}
+	return trades
+}
+
+// settleLegacy: Cách settle trước đây, giữ lại làm mốc so sánh
+func settleLegacy(ctx context.Context, tx pgx.Tx, trades []engine.Trade) error {
+	for _, t := range trades {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO trades (maker_order_id, taker_order_id, price, amount)
+			 VALUES ($1, $2, $3, $4)`,
+			t.MakerOrderID, t.TakerOrderID, t.Price, t.Amount)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range []int{t.MakerOrderID, t.TakerOrderID} {
+			_, err = tx.Exec(ctx,
+				`UPDATE orders SET filled = filled + $1,
+				 status = CASE WHEN filled + $1 >= amount THEN 'FILLED' ELSE 'PARTIAL' END
+				 WHERE id = $2`, t.Amount, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		var makerID, takerID int
+		var makerSide string
+		err = tx.QueryRow(ctx, "SELECT user_id, side FROM orders WHERE id=$1", t.MakerOrderID).Scan(&makerID, &makerSide)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRow(ctx, "SELECT user_id FROM orders WHERE id=$1", t.TakerOrderID).Scan(&takerID)
+		if err != nil {
+			return err
+		}
+
+		costUSDT := t.Price * t.Amount
+		buyerID, sellerID := makerID, takerID
+		if makerSide == "SELL" {
+			buyerID, sellerID = takerID, makerID
+		}
+
+		updates := []struct {
+			sql    string
+			amount float64
+			userID int
+		}{
+			{`UPDATE balances SET locked = locked - $1 WHERE user_id=$2 AND asset_symbol='USDT'`, costUSDT, buyerID},
+			{`UPDATE balances SET available = available + $1 WHERE user_id=$2 AND asset_symbol='BTC'`, t.Amount, buyerID},
+			{`UPDATE balances SET locked = locked - $1 WHERE user_id=$2 AND asset_symbol='BTC'`, t.Amount, sellerID},
+			{`UPDATE balances SET available = available + $1 WHERE user_id=$2 AND asset_symbol='USDT'`, costUSDT, sellerID},
+		}
+		for _, u := range updates {
+			if _, err := tx.Exec(ctx, u.sql, u.amount, u.userID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -3,9 +3,23 @@ CREATE TABLE users (
     id SERIAL PRIMARY KEY,
     email VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
+    verification_tier INT NOT NULL DEFAULT 0, -- Cấp xác minh (KYC), quyết định hạn mức rút
+    parent_id INT REFERENCES users(id), -- Khác NULL nghĩa là sub-account của user parent_id
+    label VARCHAR(64), -- Tên sub-account do master đặt
+    frozen BOOLEAN NOT NULL DEFAULT false, -- Tài khoản bị đóng băng: không được đặt lệnh/rút/chuyển đi
+    totp_secret VARCHAR(64), -- Secret TOTP (base32), có từ lúc setup, chỉ có hiệu lực khi totp_enabled
+    totp_enabled BOOLEAN NOT NULL DEFAULT false,
+    totp_last_step BIGINT NOT NULL DEFAULT 0, -- Bước TOTP đã dùng gần nhất, chống dùng lại code
+    totp_failed_attempts INT NOT NULL DEFAULT 0, -- Số lần nhập sai mã 2FA liên tiếp
+    totp_locked_until TIMESTAMP, -- Nhập sai quá nhiều: khoá xác thực 2FA tới thời điểm này
+    role VARCHAR(16) NOT NULL DEFAULT 'trader' CHECK (role IN ('trader', 'support', 'admin', 'auditor')),
+    role_granted_by INT REFERENCES users(id), -- Admin đã cấp role hiện tại (NULL: mặc định hoặc seed)
+    role_approved_by INT REFERENCES users(id), -- Admin thứ hai duyệt việc cấp role admin
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE UNIQUE INDEX idx_users_parent_label ON users(parent_id, label) WHERE parent_id IS NOT NULL;
+
 -- ASSETS
 CREATE TABLE assets (
     symbol VARCHAR(10) PRIMARY KEY,
@@ -33,26 +47,279 @@ CREATE TABLE orders (
     amount DECIMAL(20, 8) NOT NULL,
     filled DECIMAL(20, 8) DEFAULT 0,
     status VARCHAR(20) DEFAULT 'OPEN',
+    client_order_id VARCHAR(36), -- ID do client tự đặt (idempotency), duy nhất theo user
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE UNIQUE INDEX idx_orders_client_order_id ON orders(user_id, client_order_id) WHERE client_order_id IS NOT NULL;
+-- Tra cứu lệnh của user, phân trang theo id giảm dần
+CREATE INDEX idx_orders_user ON orders(user_id, id);
+CREATE INDEX idx_orders_user_symbol ON orders(user_id, symbol, id);
+CREATE INDEX idx_orders_user_open ON orders(user_id, id) WHERE status IN ('OPEN', 'PARTIAL');
+
 -- TRADES
 CREATE TABLE trades (
     id SERIAL PRIMARY KEY,
+    symbol VARCHAR(20),
     maker_order_id INT REFERENCES orders(id),
     taker_order_id INT REFERENCES orders(id),
+    taker_side VARCHAR(4), -- Phía chủ động khớp (aggressor)
     price DECIMAL(20, 8) NOT NULL,
     amount DECIMAL(20, 8) NOT NULL,
+    maker_fee DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    maker_fee_asset VARCHAR(10),
+    taker_fee DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    taker_fee_asset VARCHAR(10),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+-- Tra fill của user: orders(user_id) -> trades theo từng phía
+CREATE INDEX idx_trades_maker_order ON trades(maker_order_id);
+CREATE INDEX idx_trades_taker_order ON trades(taker_order_id);
+CREATE INDEX idx_trades_symbol ON trades(symbol, id);
+
+-- CANDLES: Nến OHLCV tổng hợp từ trades theo từng khung (1m, 5m, 15m, 1h, 4h, 1d)
+CREATE TABLE candles (
+    symbol VARCHAR(20) NOT NULL,
+    period VARCHAR(3) NOT NULL,
+    open_time TIMESTAMP NOT NULL, -- Thời điểm mở nến (UTC)
+    open DECIMAL(20, 8) NOT NULL,
+    high DECIMAL(20, 8) NOT NULL,
+    low DECIMAL(20, 8) NOT NULL,
+    close DECIMAL(20, 8) NOT NULL,
+    volume DECIMAL(20, 8) NOT NULL,
+    trade_count INT NOT NULL,
+    first_trade_id BIGINT NOT NULL, -- Xác định open/close khi trade được settle không theo thứ tự
+    last_trade_id BIGINT NOT NULL,
+    PRIMARY KEY (symbol, period, open_time)
+);
+
+-- LEDGER: Nhật ký mọi biến động số dư (available/locked) ngoài khớp lệnh
+CREATE TABLE ledger_entries (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id),
+    asset_symbol VARCHAR(10) REFERENCES assets(symbol),
+    available_delta DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    locked_delta DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    entry_type VARCHAR(30) NOT NULL, -- WITHDRAWAL_HOLD, WITHDRAWAL_RELEASE, WITHDRAWAL, TRANSFER_IN, TRANSFER_OUT...
+    ref_id BIGINT, -- ID của bản ghi gốc (withdrawals.id, transfers.id, ...)
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_ledger_entries_user ON ledger_entries(user_id, created_at);
+
+-- WITHDRAWAL LIMITS: Hạn mức rút theo ngày và ngưỡng duyệt tay, theo cấp xác minh
+CREATE TABLE withdrawal_limits (
+    tier INT NOT NULL,
+    asset_symbol VARCHAR(10) REFERENCES assets(symbol),
+    daily_limit DECIMAL(20, 8) NOT NULL,
+    review_threshold DECIMAL(20, 8) NOT NULL, -- Lệnh rút >= ngưỡng này phải chờ admin duyệt
+    PRIMARY KEY (tier, asset_symbol)
+);
+
+-- WITHDRAWAL ADDRESSES: Danh sách địa chỉ rút được phép (whitelist)
+CREATE TABLE withdrawal_addresses (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id),
+    asset_symbol VARCHAR(10) REFERENCES assets(symbol),
+    address VARCHAR(128) NOT NULL,
+    label VARCHAR(64),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    active_at TIMESTAMP NOT NULL, -- Hết thời gian chờ (cooling-off) mới được dùng
+    UNIQUE (user_id, asset_symbol, address)
+);
+
+-- WITHDRAWALS
+CREATE TABLE withdrawals (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id),
+    asset_symbol VARCHAR(10) REFERENCES assets(symbol),
+    address VARCHAR(128) NOT NULL,
+    amount DECIMAL(20, 8) NOT NULL,
+    status VARCHAR(20) NOT NULL, -- PENDING_REVIEW, APPROVED, REJECTED, CANCELLED, COMPLETED
+    reviewed_by INT REFERENCES users(id),
+    reviewed_at TIMESTAMP,
+    note TEXT,
+    tx_hash VARCHAR(128),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (amount > 0)
+);
+
+CREATE INDEX idx_withdrawals_user ON withdrawals(user_id, asset_symbol, created_at);
+CREATE INDEX idx_withdrawals_status ON withdrawals(status);
+
+-- TRANSFERS: Chuyển tiền nội bộ giữa các user (không qua blockchain)
+CREATE TABLE transfers (
+    id SERIAL PRIMARY KEY,
+    from_user_id INT REFERENCES users(id),
+    to_user_id INT REFERENCES users(id),
+    asset_symbol VARCHAR(10) REFERENCES assets(symbol),
+    amount DECIMAL(20, 8) NOT NULL,
+    idempotency_key VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (from_user_id, idempotency_key),
+    CHECK (amount > 0),
+    CHECK (from_user_id <> to_user_id)
+);
+
+CREATE INDEX idx_transfers_from ON transfers(from_user_id, created_at);
+CREATE INDEX idx_transfers_to ON transfers(to_user_id, created_at);
+
+-- API KEYS: Key cho bot giao dịch; user_id là tài khoản mà key được phép thao tác
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id),
+    created_by INT REFERENCES users(id), -- Master tạo key cho sub-account
+    api_key VARCHAR(64) UNIQUE NOT NULL,
+    secret VARCHAR(128) NOT NULL,
+    label VARCHAR(64),
+    permissions TEXT[] NOT NULL DEFAULT '{read}', -- read, trade, withdraw
+    allowed_ips TEXT[] NOT NULL DEFAULT '{}',     -- IP hoặc CIDR, rỗng = không giới hạn
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_api_keys_user ON api_keys(user_id);
+
+-- SETTLEMENT QUEUE: Trades khớp trên RAM được lưu ở đây trước, settle sau (có retry)
+CREATE TABLE settlement_batches (
+    id BIGSERIAL PRIMARY KEY,
+    symbol VARCHAR(20) NOT NULL,
+    trades JSONB NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'PENDING', -- PENDING, SETTLED, DEAD
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    settled_at TIMESTAMP
+);
+
+CREATE INDEX idx_settlement_batches_pending ON settlement_batches(next_attempt_at) WHERE status = 'PENDING';
+
+-- SETTLEMENT DEAD LETTERS: Batch lỗi vĩnh viễn, admin kiểm tra và replay
+CREATE TABLE settlement_dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    batch_id BIGINT REFERENCES settlement_batches(id),
+    symbol VARCHAR(20) NOT NULL,
+    trades JSONB NOT NULL,
+    attempts INT NOT NULL,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    replayed_at TIMESTAMP,
+    replayed_by INT REFERENCES users(id)
+);
+
+-- SESSIONS: Phiên đăng nhập, chỉ lưu SHA-256 của token
+CREATE TABLE sessions (
+    id SERIAL PRIMARY KEY,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    user_id INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_sessions_user ON sessions(user_id);
+
+-- TOTP RECOVERY CODES: Dùng thay TOTP khi mất điện thoại, mỗi code dùng một lần
+CREATE TABLE totp_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id),
+    code_hash CHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_totp_recovery_codes_user ON totp_recovery_codes(user_id);
+
+-- Dùng cho các bảng chỉ được INSERT (audit log...)
+CREATE FUNCTION forbid_modification() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+-- ADMIN AUDIT LOG: Ai làm gì, lúc nào, với tham số gì trên /admin
+CREATE TABLE admin_audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    admin_id INT REFERENCES users(id),
+    role VARCHAR(16) NOT NULL,
+    action VARCHAR(128) NOT NULL,
+    params JSONB NOT NULL DEFAULT '{}',
+    status_code INT NOT NULL,
+    ip VARCHAR(64) NOT NULL DEFAULT '',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE INDEX idx_admin_audit_log_admin ON admin_audit_log(admin_id, id);
+
+CREATE TRIGGER admin_audit_log_append_only
+BEFORE UPDATE OR DELETE ON admin_audit_log
+FOR EACH ROW EXECUTE FUNCTION forbid_modification();
+
+-- ROLE GRANTS: Cấp role admin cần admin thứ hai (khác người yêu cầu và người được cấp) duyệt
+CREATE TABLE role_grants (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id),
+    role VARCHAR(16) NOT NULL,
+    requested_by INT REFERENCES users(id),
+    status VARCHAR(10) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'APPROVED', 'REJECTED')),
+    decided_by INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    decided_at TIMESTAMP
+);
+
+-- BALANCE ADJUSTMENTS: Điều chỉnh số dư thủ công, cần admin thứ hai duyệt.
+-- Cả yêu cầu lẫn quyết định đều chỉ được INSERT.
+CREATE TABLE balance_adjustments (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id),
+    asset_symbol VARCHAR(10) REFERENCES assets(symbol),
+    amount DECIMAL(20, 8) NOT NULL CHECK (amount <> 0), -- > 0: cộng, < 0: trừ
+    reason_code VARCHAR(32) NOT NULL,
+    note TEXT,
+    requested_by INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE balance_adjustment_decisions (
+    id SERIAL PRIMARY KEY,
+    adjustment_id INT UNIQUE REFERENCES balance_adjustments(id), -- Mỗi yêu cầu chỉ có một quyết định
+    admin_id INT REFERENCES users(id),
+    decision VARCHAR(10) NOT NULL CHECK (decision IN ('APPROVED', 'REJECTED')),
+    note TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER balance_adjustments_append_only
+BEFORE UPDATE OR DELETE ON balance_adjustments
+FOR EACH ROW EXECUTE FUNCTION forbid_modification();
+
+CREATE TRIGGER balance_adjustment_decisions_append_only
+BEFORE UPDATE OR DELETE ON balance_adjustment_decisions
+FOR EACH ROW EXECUTE FUNCTION forbid_modification();
+
 -- SEED DATA
 INSERT INTO assets(symbol, precision) VALUES
 ('BTC', 8),
 ('USDT', 6);
 
-INSERT INTO users(email, password_hash)
-VALUES ('userA@test.com', 'hash');
+INSERT INTO withdrawal_limits(tier, asset_symbol, daily_limit, review_threshold) VALUES
+(0, 'BTC', 0.5, 0.1),
+(0, 'USDT', 20000, 5000),
+(1, 'BTC', 10, 2),
+(1, 'USDT', 500000, 100000),
+(2, 'BTC', 100, 20),
+(2, 'USDT', 5000000, 1000000);
+
+-- Password: password123 (bcrypt). User 1 là admin để dùng được các API /admin.
+-- Admin thứ hai (người duyệt) được cấp lúc khởi động qua BOOTSTRAP_ADMIN_EMAIL, không seed ở đây để giữ ID của user simulation
+INSERT INTO users(email, password_hash, role)
+VALUES ('userA@test.com', '$2a$10$Ya5Zj7aQqxAJhC0Iqu4HfOERYFqoIg7qlOYlNaugteogyfH1Ba7m.', 'admin');
+
+-- Tài khoản thu phí giao dịch (engine.FeeAccountUserID). id 0 nằm ngoài SERIAL nên không đổi ID các user khác;
+-- password_hash không phải bcrypt nên không đăng nhập được
+INSERT INTO users(id, email, password_hash)
+VALUES (0, 'fees@system.local', '!');
 
 INSERT INTO balances(user_id, asset_symbol, available)
 VALUES
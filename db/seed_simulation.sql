@@ -1,11 +1,11 @@
 -- Seed data cho simulation
 -- Tạo thêm users và balances cho user 1-10
 
--- Tạo users (nếu chưa có)
+-- Tạo users (nếu chưa có) - Password: password123 (bcrypt)
 INSERT INTO users(email, password_hash)
 SELECT 
     'user' || generate_series || '@test.com',
-    'hash'
+    '$2a$10$Ya5Zj7aQqxAJhC0Iqu4HfOERYFqoIg7qlOYlNaugteogyfH1Ba7m.'
 FROM generate_series(2, 10)
 ON CONFLICT (email) DO NOTHING;
 
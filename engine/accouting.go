@@ -9,7 +9,12 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func CreateBuyOrder(db *pgxpool.Pool, userID int, symbol string, price, amount float64) (int, error) {
+var (
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrAccountFrozen       = errors.New("account is frozen")
+)
+
+func CreateBuyOrder(db *pgxpool.Pool, userID int, symbol string, price, amount float64, clientOrderID string) (int, error) {
 	ctx := context.Background()
 	tx, err := db.Begin(ctx)
 	if err != nil {
@@ -23,10 +28,12 @@ func CreateBuyOrder(db *pgxpool.Pool, userID int, symbol string, price, amount f
 
 	// 1. Check balance
 	var available float64
+	var frozen bool
 	err = tx.QueryRow(ctx,
-		`SELECT available FROM balances
-		 WHERE user_id=$1 AND asset_symbol='USDT' FOR UPDATE`,
-		userID).Scan(&available)
+		`SELECT b.available, u.frozen FROM balances b
+		 JOIN users u ON u.id = b.user_id
+		 WHERE b.user_id=$1 AND b.asset_symbol='USDT' FOR UPDATE OF b`,
+		userID).Scan(&available, &frozen)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -37,11 +44,16 @@ func CreateBuyOrder(db *pgxpool.Pool, userID int, symbol string, price, amount f
 		return 0, err
 	}
 
+	if frozen {
+		log.Printf("CreateBuyOrder: User %d is frozen", userID)
+		return 0, ErrAccountFrozen
+	}
+
 	log.Printf("CreateBuyOrder: User %d has %f USDT available, need %f", userID, available, cost)
 
 	if available < cost {
 		log.Printf("CreateBuyOrder: User %d insufficient balance: %f < %f", userID, available, cost)
-		return 0, errors.New("insufficient balance")
+		return 0, ErrInsufficientBalance
 	}
 
 	// 2. Update balances
@@ -58,13 +70,13 @@ func CreateBuyOrder(db *pgxpool.Pool, userID int, symbol string, price, amount f
 	// 3. Create order
 	var orderID int
 	err = tx.QueryRow(ctx,
-		`INSERT INTO orders (user_id, symbol, side, price, amount)
-		 VALUES ($1,$2,'BUY',$3,$4)
+		`INSERT INTO orders (user_id, symbol, side, price, amount, client_order_id)
+		 VALUES ($1,$2,'BUY',$3,$4,NULLIF($5,''))
 		 RETURNING id`,
-		userID, symbol, price, amount).Scan(&orderID)
+		userID, symbol, price, amount, clientOrderID).Scan(&orderID)
 
 	if err != nil {
-		return 0, err
+		return 0, mapClientOrderIDConflict(err)
 	}
 
 	err = tx.Commit(ctx)
@@ -75,7 +87,7 @@ func CreateBuyOrder(db *pgxpool.Pool, userID int, symbol string, price, amount f
 	return orderID, nil
 }
 
-func CreateSellOrder(db *pgxpool.Pool, userID int, symbol string, price, amount float64) (int, error) {
+func CreateSellOrder(db *pgxpool.Pool, userID int, symbol string, price, amount float64, clientOrderID string) (int, error) {
 	ctx := context.Background()
 	tx, err := db.Begin(ctx)
 	if err != nil {
@@ -92,10 +104,12 @@ func CreateSellOrder(db *pgxpool.Pool, userID int, symbol string, price, amount
 
 	// 1. Check balance BTC
 	var available float64
+	var frozen bool
 	err = tx.QueryRow(ctx,
-		`SELECT available FROM balances
-		 WHERE user_id=$1 AND asset_symbol=$2 FOR UPDATE`,
-		userID, assetToLock).Scan(&available)
+		`SELECT b.available, u.frozen FROM balances b
+		 JOIN users u ON u.id = b.user_id
+		 WHERE b.user_id=$1 AND b.asset_symbol=$2 FOR UPDATE OF b`,
+		userID, assetToLock).Scan(&available, &frozen)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -106,11 +120,16 @@ func CreateSellOrder(db *pgxpool.Pool, userID int, symbol string, price, amount
 		return 0, err
 	}
 
+	if frozen {
+		log.Printf("CreateSellOrder: User %d is frozen", userID)
+		return 0, ErrAccountFrozen
+	}
+
 	log.Printf("CreateSellOrder: User %d has %f BTC available, need %f", userID, available, cost)
 
 	if available < cost {
 		log.Printf("CreateSellOrder: User %d insufficient balance: %f < %f", userID, available, cost)
-		return 0, errors.New("insufficient balance")
+		return 0, ErrInsufficientBalance
 	}
 
 	// 2. Update balances (Trừ BTC available, cộng BTC locked)
@@ -127,13 +146,13 @@ func CreateSellOrder(db *pgxpool.Pool, userID int, symbol string, price, amount
 	// 3. Insert Order (Side = 'SELL')
 	var orderID int
 	err = tx.QueryRow(ctx,
-		`INSERT INTO orders (user_id, symbol, side, price, amount)
-		 VALUES ($1,$2,'SELL',$3,$4)
+		`INSERT INTO orders (user_id, symbol, side, price, amount, client_order_id)
+		 VALUES ($1,$2,'SELL',$3,$4,NULLIF($5,''))
 		 RETURNING id`,
-		userID, symbol, price, amount).Scan(&orderID)
+		userID, symbol, price, amount, clientOrderID).Scan(&orderID)
 
 	if err != nil {
-		return 0, err
+		return 0, mapClientOrderIDConflict(err)
 	}
 
 	err = tx.Commit(ctx)
@@ -143,72 +162,3 @@ func CreateSellOrder(db *pgxpool.Pool, userID int, symbol string, price, amount
 
 	return orderID, nil
 }
-
-func CancelOrder(db *pgxpool.Pool, orderID int, userID int) error {
-	ctx := context.Background()
-	tx, err := db.Begin(ctx)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback(ctx)
-
-	var status, side, symbol string
-	var price, amount, filled float64
-
-	// Lấy thêm 'side' và 'symbol' để biết trả lại tiền gì
-	err = tx.QueryRow(ctx,
-		`SELECT status, side, symbol, price, amount, filled
-		 FROM orders
-		 WHERE id=$1 AND user_id=$2
-		 FOR UPDATE`,
-		orderID, userID).
-		Scan(&status, &side, &symbol, &price, &amount, &filled)
-
-	if err != nil {
-		return err 
-	}
-
-	if status != "OPEN" && status != "PARTIAL" {
-		return errors.New("order cannot be cancelled")
-	}
-
-	var assetToRefund string
-	var amountToRefund float64
-
-	// Giả sử symbol là "BTC_USDT" -> Cần tách chuỗi để lấy Base (BTC) và Quote (USDT)
-	// Để đơn giản cho demo, ta hardcode logic cắt chuỗi hoặc quy ước
-	// Ở đây giả định symbol format chuẩn là "BASE_QUOTE"
-
-	if side == "BUY" {
-		// Mua BTC bằng USDT -> Trả lại USDT
-		assetToRefund = "USDT"
-		amountToRefund = (amount - filled) * price
-	} else { // SELL
-		// Bán BTC lấy USDT -> Trả lại BTC
-		assetToRefund = "BTC"
-		amountToRefund = amount - filled
-	}
-
-	// Unlock funds (Cộng lại Available, Trừ Locked)
-	_, err = tx.Exec(ctx,
-		`UPDATE balances
-		 SET available = available + $1,
-		     locked = locked - $1
-		 WHERE user_id=$2 AND asset_symbol=$3`,
-		amountToRefund, userID, assetToRefund)
-
-	if err != nil {
-		return err
-	}
-
-	_, err = tx.Exec(ctx,
-		`UPDATE orders SET status='CANCELLED'
-		 WHERE id=$1`,
-		orderID)
-
-	if err != nil {
-		return err
-	}
-
-	return tx.Commit(ctx)
-}
@@ -0,0 +1,238 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Trạng thái điều chỉnh số dư (suy ra từ bảng approvals, không lưu trực tiếp)
+const (
+	AdjustmentPending  = "PENDING"
+	AdjustmentApproved = "APPROVED"
+	AdjustmentRejected = "REJECTED"
+)
+
+// Lý do điều chỉnh số dư thủ công
+const (
+	ReasonMissedDeposit   = "MISSED_DEPOSIT"   // Nạp tiền không được ghi nhận
+	ReasonErrorCorrection = "ERROR_CORRECTION" // Sửa sai do lỗi hệ thống/vận hành
+	ReasonCompensation    = "COMPENSATION"     // Bồi thường cho user
+	ReasonFeeRefund       = "FEE_REFUND"       // Hoàn phí
+	ReasonChargeback      = "CHARGEBACK"       // Thu hồi tiền đã cộng nhầm
+)
+
+var validReasonCodes = []string{ReasonMissedDeposit, ReasonErrorCorrection, ReasonCompensation, ReasonFeeRefund, ReasonChargeback}
+
+var (
+	ErrAdjustmentNotFound     = errors.New("balance adjustment not found")
+	ErrAdjustmentDecided      = errors.New("balance adjustment has already been approved or rejected")
+	ErrSelfApproval           = errors.New("an adjustment must be approved by an admin other than the requester and the account holder")
+	ErrLinkedApproval         = errors.New("an adjustment cannot be approved by an admin who granted the requester's role, or whose role the requester granted")
+	ErrInvalidReasonCode      = errors.New("invalid reason code")
+	ErrInvalidAdjustmentValue = errors.New("adjustment amount must be non-zero")
+)
+
+// BalanceAdjustment: Bản ghi gốc không bao giờ bị sửa, quyết định duyệt nằm ở bảng riêng
+type BalanceAdjustment struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id"`
+	Asset        string     `json:"asset"`
+	Amount       float64    `json:"amount"` // > 0: cộng, < 0: trừ vào available
+	ReasonCode   string     `json:"reason_code"`
+	Note         string     `json:"note"`
+	RequestedBy  int        `json:"requested_by"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Status       string     `json:"status"`
+	DecidedBy    *int       `json:"decided_by,omitempty"`
+	DecisionNote *string    `json:"decision_note,omitempty"`
+	DecidedAt    *time.Time `json:"decided_at,omitempty"`
+}
+
+const adjustmentSelect = `
+	SELECT a.id, a.user_id, a.asset_symbol, a.amount, a.reason_code, COALESCE(a.note, ''),
+	       a.requested_by, a.created_at, COALESCE(d.decision, 'PENDING'), d.admin_id, d.note, d.created_at
+	FROM balance_adjustments a
+	LEFT JOIN balance_adjustment_decisions d ON d.adjustment_id = a.id`
+
+func scanAdjustment(row pgx.Row) (*BalanceAdjustment, error) {
+	var a BalanceAdjustment
+	err := row.Scan(&a.ID, &a.UserID, &a.Asset, &a.Amount, &a.ReasonCode, &a.Note,
+		&a.RequestedBy, &a.CreatedAt, &a.Status, &a.DecidedBy, &a.DecisionNote, &a.DecidedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// RequestBalanceAdjustment: Tạo yêu cầu, chưa động vào balances cho tới khi admin khác duyệt
+func RequestBalanceAdjustment(db *pgxpool.Pool, requestedBy, userID int, asset string, amount float64, reasonCode, note string) (*BalanceAdjustment, error) {
+	if amount == 0 {
+		return nil, ErrInvalidAdjustmentValue
+	}
+	if !slices.Contains(validReasonCodes, reasonCode) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidReasonCode, reasonCode)
+	}
+
+	ctx := context.Background()
+	var exists bool
+	err := db.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM balances WHERE user_id=$1 AND asset_symbol=$2)`,
+		userID, asset).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	var id int
+	err = db.QueryRow(ctx,
+		`INSERT INTO balance_adjustments (user_id, asset_symbol, amount, reason_code, note, requested_by)
+		 VALUES ($1,$2,$3,$4,$5,$6)
+		 RETURNING id`,
+		userID, asset, amount, reasonCode, note, requestedBy).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("RequestBalanceAdjustment: Admin %d requested #%d: user %d %+f %s (%s)", requestedBy, id, userID, amount, asset, reasonCode)
+	return GetBalanceAdjustment(db, id)
+}
+
+func GetBalanceAdjustment(db *pgxpool.Pool, id int) (*BalanceAdjustment, error) {
+	ctx := context.Background()
+	a, err := scanAdjustment(db.QueryRow(ctx, adjustmentSelect+` WHERE a.id=$1`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrAdjustmentNotFound
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// ListBalanceAdjustments: status rỗng = tất cả, mới nhất lên trước
+func ListBalanceAdjustments(db *pgxpool.Pool, status string) ([]BalanceAdjustment, error) {
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		adjustmentSelect+`
+		 WHERE $1 = '' OR COALESCE(d.decision, 'PENDING') = $1
+		 ORDER BY a.id DESC
+		 LIMIT 500`,
+		status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	adjustments := make([]BalanceAdjustment, 0)
+	for rows.Next() {
+		a, err := scanAdjustment(rows)
+		if err != nil {
+			return nil, err
+		}
+		adjustments = append(adjustments, *a)
+	}
+	return adjustments, rows.Err()
+}
+
+// ApproveBalanceAdjustment: Admin thứ hai duyệt, ghi quyết định và cập nhật balances qua ledger
+func ApproveBalanceAdjustment(db *pgxpool.Pool, id, approverID int, note string) (*BalanceAdjustment, error) {
+	return decideBalanceAdjustment(db, id, approverID, AdjustmentApproved, note)
+}
+
+func RejectBalanceAdjustment(db *pgxpool.Pool, id, approverID int, note string) (*BalanceAdjustment, error) {
+	return decideBalanceAdjustment(db, id, approverID, AdjustmentRejected, note)
+}
+
+func decideBalanceAdjustment(db *pgxpool.Pool, id, adminID int, decision, note string) (*BalanceAdjustment, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Khoá bản ghi gốc để hai admin không duyệt cùng lúc
+	a, err := scanAdjustment(tx.QueryRow(ctx,
+		adjustmentSelect+` WHERE a.id=$1 FOR UPDATE OF a`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrAdjustmentNotFound
+		}
+		return nil, err
+	}
+	if a.Status != AdjustmentPending {
+		return nil, ErrAdjustmentDecided
+	}
+	if decision == AdjustmentApproved && (a.RequestedBy == adminID || a.UserID == adminID) {
+		return nil, ErrSelfApproval
+	}
+	if decision == AdjustmentApproved {
+		// Sub-account của người duyệt cũng là tiền của người duyệt (master rút về được)
+		var ownSubAccount bool
+		err = tx.QueryRow(ctx,
+			`SELECT EXISTS (SELECT 1 FROM users WHERE id=$1 AND parent_id=$2)`,
+			a.UserID, adminID).Scan(&ownSubAccount)
+		if err != nil {
+			return nil, err
+		}
+		if ownSubAccount {
+			return nil, ErrSelfApproval
+		}
+
+		// Tài khoản do chính người kia cấp quyền không phải là "người thứ hai" độc lập
+		var linked bool
+		err = tx.QueryRow(ctx,
+			`SELECT EXISTS (
+			     SELECT 1 FROM users r, users a
+			     WHERE r.id=$1 AND a.id=$2
+			       AND (a.id IN (r.role_granted_by, r.role_approved_by) OR r.id IN (a.role_granted_by, a.role_approved_by))
+			 )`,
+			a.RequestedBy, adminID).Scan(&linked)
+		if err != nil {
+			return nil, err
+		}
+		if linked {
+			return nil, ErrLinkedApproval
+		}
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO balance_adjustment_decisions (adjustment_id, admin_id, decision, note)
+		 VALUES ($1,$2,$3,$4)`,
+		id, adminID, decision, note)
+	if err != nil {
+		return nil, err
+	}
+
+	if decision == AdjustmentApproved {
+		var available float64
+		err = tx.QueryRow(ctx,
+			`SELECT available FROM balances WHERE user_id=$1 AND asset_symbol=$2 FOR UPDATE`,
+			a.UserID, a.Asset).Scan(&available)
+		if err != nil {
+			return nil, err
+		}
+		if available+a.Amount < 0 {
+			return nil, ErrInsufficientBalance
+		}
+		if err := addLedgerEntry(ctx, tx, a.UserID, a.Asset, a.Amount, 0, LedgerAdjustment, id); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	log.Printf("decideBalanceAdjustment: Admin %d %s #%d (requested by %d)", adminID, decision, id, a.RequestedBy)
+	return GetBalanceAdjustment(db, id)
+}
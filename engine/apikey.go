@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Quyền của API key
+const (
+	PermRead     = "read"     // Xem số dư, lệnh, lịch sử
+	PermTrade    = "trade"    // Đặt/huỷ lệnh
+	PermWithdraw = "withdraw" // Rút tiền, chuyển tiền, quản lý địa chỉ rút
+)
+
+var validPermissions = []string{PermRead, PermTrade, PermWithdraw}
+
+var (
+	ErrAPIKeyNotFound    = errors.New("api key not found")
+	ErrInvalidAPIKey     = errors.New("invalid or revoked api key")
+	ErrInvalidPermission = errors.New("invalid permission")
+)
+
+// APIKey: Thông tin key trả về khi liệt kê (không bao giờ kèm secret)
+type APIKey struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	APIKey      string     `json:"api_key"`
+	Label       string     `json:"label"`
+	Permissions []string   `json:"permissions"`
+	AllowedIPs  []string   `json:"allowed_ips"` // Rỗng = không giới hạn IP
+	CreatedAt   time.Time  `json:"created_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// HasPermission: Quyền withdraw/trade không bao hàm read, phải cấp riêng
+func (k *APIKey) HasPermission(perm string) bool {
+	return slices.Contains(k.Permissions, perm)
+}
+
+// AllowsIP: Mỗi phần tử allowlist là một IP hoặc một dải CIDR
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, allowed := range k.AllowedIPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func normalizePermissions(perms []string) ([]string, error) {
+	if len(perms) == 0 {
+		return []string{PermRead}, nil
+	}
+	out := make([]string, 0, len(perms))
+	for _, p := range perms {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if !slices.Contains(validPermissions, p) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPermission, p)
+		}
+		if !slices.Contains(out, p) {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+func normalizeAllowedIPs(ips []string) ([]string, error) {
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ip = strings.TrimSpace(ip)
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid ip or cidr: %q", ip)
+		}
+		out = append(out, ip)
+	}
+	return out, nil
+}
+
+// CreateAPIKey: Tạo key cho tài khoản userID (chính mình hoặc sub-account), do createdBy tạo.
+// Không truyền permissions thì key chỉ có quyền read. Secret chỉ được trả về đúng một lần tại đây.
+func CreateAPIKey(db *pgxpool.Pool, createdBy, userID int, label string, permissions, allowedIPs []string) (*APIKey, string, error) {
+	permissions, err := normalizePermissions(permissions)
+	if err != nil {
+		return nil, "", err
+	}
+	allowedIPs, err = normalizeAllowedIPs(allowedIPs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx := context.Background()
+	k := APIKey{UserID: userID, APIKey: key, Label: label, Permissions: permissions, AllowedIPs: allowedIPs}
+	err = db.QueryRow(ctx,
+		`INSERT INTO api_keys (user_id, created_by, api_key, secret, label, permissions, allowed_ips)
+		 VALUES ($1,$2,$3,$4,$5,$6,$7)
+		 RETURNING id, created_at`,
+		userID, createdBy, key, secret, label, permissions, allowedIPs).Scan(&k.ID, &k.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	log.Printf("CreateAPIKey: User %d created key #%d for account %d (%v)", createdBy, k.ID, userID, permissions)
+	return &k, secret, nil
+}
+
+func ListAPIKeys(db *pgxpool.Pool, userID int) ([]APIKey, error) {
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT id, user_id, api_key, COALESCE(label, ''), permissions, allowed_ips, created_at, revoked_at
+		 FROM api_keys
+		 WHERE user_id=$1
+		 ORDER BY id`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]APIKey, 0)
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.UserID, &k.APIKey, &k.Label, &k.Permissions, &k.AllowedIPs, &k.CreatedAt, &k.RevokedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey: Chủ key hoặc master đã tạo key cho sub-account đều thu hồi được
+func RevokeAPIKey(db *pgxpool.Pool, ownerID, keyID int) error {
+	ctx := context.Background()
+	tag, err := db.Exec(ctx,
+		`UPDATE api_keys SET revoked_at=NOW()
+		 WHERE id=$1 AND (user_id=$2 OR created_by=$2) AND revoked_at IS NULL`,
+		keyID, ownerID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	log.Printf("RevokeAPIKey: User %d revoked key #%d", ownerID, keyID)
+	return nil
+}
+
+// LookupAPIKey: Tìm key còn hiệu lực kèm secret để kiểm tra chữ ký
+func LookupAPIKey(db *pgxpool.Pool, apiKey string) (*APIKey, string, error) {
+	ctx := context.Background()
+	var k APIKey
+	var secret string
+	err := db.QueryRow(ctx,
+		`SELECT id, user_id, api_key, COALESCE(label, ''), permissions, allowed_ips, created_at, secret
+		 FROM api_keys
+		 WHERE api_key=$1 AND revoked_at IS NULL`,
+		apiKey).Scan(&k.ID, &k.UserID, &k.APIKey, &k.Label, &k.Permissions, &k.AllowedIPs, &k.CreatedAt, &secret)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, "", ErrInvalidAPIKey
+		}
+		return nil, "", err
+	}
+	return &k, secret, nil
+}
+
+// SignRequest: HMAC-SHA256 (hex) của timestamp + method + path (kèm query) + body.
+// Client ký đúng chuỗi này bằng secret và gửi kèm key, timestamp.
+func SignRequest(secret, timestamp, method, path string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte(strings.ToUpper(method)))
+	mac.Write([]byte(path))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature: So sánh thời gian hằng để không lộ chữ ký qua timing
+func VerifySignature(secret, timestamp, method, path string, body []byte, signature string) bool {
+	expected := SignRequest(secret, timestamp, method, path, body)
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(signature)))
+}
@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Thời gian sống của một phiên đăng nhập
+const SessionTTL = 24 * time.Hour
+
+const minPasswordLength = 8
+
+// Hash bcrypt hợp lệ dùng để so sánh khi email không tồn tại
+var dummyPasswordHash = []byte("$2a$10$Ya5Zj7aQqxAJhC0Iqu4HfOERYFqoIg7qlOYlNaugteogyfH1Ba7m.")
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrEmailTaken         = errors.New("email is already registered")
+	ErrInvalidSession     = errors.New("invalid or expired session")
+)
+
+// Session: Token chỉ trả về cho client lúc đăng nhập, DB chỉ lưu hash
+type Session struct {
+	Token     string    `json:"token"`
+	UserID    int       `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// RegisterUser: Tạo user mới với password hash bằng bcrypt và balance rỗng cho mọi asset
+func RegisterUser(db *pgxpool.Pool, email, password string) (int, error) {
+	email = normalizeEmail(email)
+	if !strings.Contains(email, "@") {
+		return 0, errors.New("invalid email")
+	}
+	if len(password) < minPasswordLength {
+		return 0, errors.New("password must be at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int
+	err = tx.QueryRow(ctx,
+		`INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id`,
+		email, string(hash)).Scan(&userID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return 0, ErrEmailTaken
+		}
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO balances (user_id, asset_symbol) SELECT $1, symbol FROM assets`,
+		userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	log.Printf("RegisterUser: User %d registered (%s)", userID, email)
+	return userID, nil
+}
+
+// VerifyPassword: Kiểm tra email/password, trả về userID nếu đúng.
+// Sub-account không có password nên không bao giờ đăng nhập được.
+func VerifyPassword(db *pgxpool.Pool, email, password string) (int, error) {
+	ctx := context.Background()
+	var userID int
+	var hash string
+	err := db.QueryRow(ctx,
+		`SELECT id, password_hash FROM users WHERE email=$1`,
+		normalizeEmail(email)).Scan(&userID, &hash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Vẫn chạy bcrypt để thời gian phản hồi không lộ email nào tồn tại
+			bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+			return 0, ErrInvalidCredentials
+		}
+		return 0, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return 0, ErrInvalidCredentials
+	}
+	return userID, nil
+}
+
+// CreateSession: Sinh token ngẫu nhiên cho user đã xác thực
+func CreateSession(db *pgxpool.Pool, userID int) (*Session, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	s := Session{Token: token, UserID: userID}
+	err = db.QueryRow(ctx,
+		`INSERT INTO sessions (token_hash, user_id, expires_at)
+		 VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')
+		 RETURNING expires_at`,
+		hashToken(token), userID, SessionTTL.Seconds()).Scan(&s.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Login: Xác thực email/password (và TOTP nếu user đã bật 2FA) rồi tạo phiên mới
+func Login(db *pgxpool.Pool, email, password, otp string) (*Session, error) {
+	userID, err := VerifyPassword(db, email, password)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifySecondFactor(db, userID, otp); err != nil {
+		return nil, err
+	}
+	log.Printf("Login: User %d logged in", userID)
+	return CreateSession(db, userID)
+}
+
+func Logout(db *pgxpool.Pool, token string) error {
+	ctx := context.Background()
+	_, err := db.Exec(ctx,
+		`UPDATE sessions SET revoked_at=NOW() WHERE token_hash=$1 AND revoked_at IS NULL`,
+		hashToken(token))
+	return err
+}
+
+// Authenticate: Đổi session token thành userID
+func Authenticate(db *pgxpool.Pool, token string) (int, error) {
+	if token == "" {
+		return 0, ErrInvalidSession
+	}
+
+	ctx := context.Background()
+	var userID int
+	err := db.QueryRow(ctx,
+		`SELECT user_id FROM sessions
+		 WHERE token_hash=$1 AND revoked_at IS NULL AND expires_at > NOW()`,
+		hashToken(token)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrInvalidSession
+		}
+		return 0, err
+	}
+	return userID, nil
+}
@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"context"
+	"log"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// BalanceUpdate: Số dư mới nhất (sau khi commit) của các asset vừa thay đổi của một user
+type BalanceUpdate struct {
+	UserID   int            `json:"user_id"`
+	Balances []AssetBalance `json:"balances"`
+}
+
+// GetBalances: Số dư available/locked theo từng asset của user
+func GetBalances(db *pgxpool.Pool, userID int) ([]AssetBalance, error) {
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT asset_symbol, available, locked FROM balances WHERE user_id=$1 ORDER BY asset_symbol`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := make([]AssetBalance, 0)
+	for rows.Next() {
+		var b AssetBalance
+		if err := rows.Scan(&b.Asset, &b.Available, &b.Locked); err != nil {
+			return nil, err
+		}
+		balances = append(balances, b)
+	}
+	return balances, rows.Err()
+}
+
+// OnBalanceUpdate: Đăng ký hàm nhận BalanceUpdate. Chỉ gọi lúc khởi động, trước khi nhận lệnh
+// và trước RunSettlementWorker (danh sách handler không có khoá).
+// Hàm được gọi đồng bộ trên luồng xử lý lệnh/settlement nên không được chặn lâu.
+func (e *Engine) OnBalanceUpdate(fn func(BalanceUpdate)) {
+	e.balanceHandlers = append(e.balanceHandlers, fn)
+}
+
+// publishBalances: Đọc lại các dòng balance vừa thay đổi và báo cho các handler, mỗi user một BalanceUpdate.
+// Lỗi chỉ ghi log: giao dịch đã commit, client có thể lấy lại qua GET /balances.
+func (e *Engine) publishBalances(keys []balanceKey) {
+	if len(e.balanceHandlers) == 0 || len(keys) == 0 {
+		return
+	}
+
+	userIDs := make([]int, len(keys))
+	assets := make([]string, len(keys))
+	for i, k := range keys {
+		userIDs[i], assets[i] = k.userID, k.asset
+	}
+
+	ctx := context.Background()
+	rows, err := e.DB.Query(ctx,
+		`SELECT b.user_id, b.asset_symbol, b.available, b.locked
+		 FROM balances b
+		 JOIN (SELECT DISTINCT * FROM unnest($1::int[], $2::varchar[])) AS k(user_id, asset)
+		   ON b.user_id = k.user_id AND b.asset_symbol = k.asset
+		 ORDER BY b.user_id, b.asset_symbol`,
+		userIDs, assets)
+	if err != nil {
+		log.Printf("publishBalances: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var updates []BalanceUpdate
+	for rows.Next() {
+		var userID int
+		var b AssetBalance
+		if err := rows.Scan(&userID, &b.Asset, &b.Available, &b.Locked); err != nil {
+			log.Printf("publishBalances: %v", err)
+			return
+		}
+		if n := len(updates); n == 0 || updates[n-1].UserID != userID {
+			updates = append(updates, BalanceUpdate{UserID: userID})
+		}
+		updates[len(updates)-1].Balances = append(updates[len(updates)-1].Balances, b)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("publishBalances: %v", err)
+		return
+	}
+
+	for _, u := range updates {
+		for _, fn := range e.balanceHandlers {
+			fn(u)
+		}
+	}
+}
+
+// tradeBalanceKeys: Các dòng balance mà SettleTrades thay đổi
+func tradeBalanceKeys(trades []Trade) []balanceKey {
+	keys := make([]balanceKey, 0, 4*len(trades))
+	for _, t := range trades {
+		base, quote := splitSymbol(t.Symbol)
+		for _, userID := range []int{t.MakerUserID, t.TakerUserID} {
+			keys = append(keys, balanceKey{userID, base}, balanceKey{userID, quote})
+		}
+	}
+	return keys
+}
+
+// lockedAsset: Tài sản bị khoá khi đặt lệnh (mua khoá quote, bán khoá base)
+func lockedAsset(symbol, side string) string {
+	base, quote := splitSymbol(symbol)
+	if side == "BUY" {
+		return quote
+	}
+	return base
+}
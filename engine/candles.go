@@ -0,0 +1,315 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CandleIntervals: Các khung nến được tổng hợp, theo thứ tự tăng dần
+var CandleIntervals = []string{"1m", "5m", "15m", "1h", "4h", "1d"}
+
+var candleDurations = map[string]time.Duration{
+	"1m":  time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+	"4h":  4 * time.Hour,
+	"1d":  24 * time.Hour,
+}
+
+var ErrInvalidCandleQuery = errors.New("invalid candle query")
+
+// Candle: Một nến OHLCV. Time là thời điểm mở nến (unix ms, UTC).
+type Candle struct {
+	Time   int64   `json:"time"`
+	Open   float64 `json:"open"`
+	High   float64 `json:"high"`
+	Low    float64 `json:"low"`
+	Close  float64 `json:"close"`
+	Volume float64 `json:"volume"`
+	Trades int     `json:"trades"` // Số trade trong nến, 0 với nến lấp khoảng trống
+}
+
+// CandleUpdate: Trạng thái mới của một nến; Closed = khung đã kết thúc, đây là giá trị cuối cùng
+type CandleUpdate struct {
+	Symbol   string `json:"symbol"`
+	Interval string `json:"interval"`
+	Closed   bool   `json:"closed"`
+	Candle
+}
+
+type candleKey struct {
+	symbol   string
+	interval string
+}
+
+// liveCandles: Nến đang mở mới nhất của từng market/khung, để đẩy update và bản "closed" khi hết khung
+type liveCandles struct {
+	mu      sync.Mutex
+	candles map[candleKey]Candle
+}
+
+// OnCandleUpdate: Đăng ký hàm nhận update nến, cùng quy ước với OnBalanceUpdate.
+// Được gọi khi giữ khoá nến để các update của cùng một nến đi ra đúng thứ tự; handler không được chặn.
+func (e *Engine) OnCandleUpdate(fn func(CandleUpdate)) {
+	e.candleHandlers = append(e.candleHandlers, fn)
+}
+
+func (e *Engine) publishCandleLocked(u CandleUpdate) {
+	for _, fn := range e.candleHandlers {
+		fn(u)
+	}
+}
+
+// candlePeriodsSQL: Bảng (period, seconds) của mọi khung nến, dựng một lần từ CandleIntervals
+var candlePeriodsSQL = func() string {
+	rows := make([]string, len(CandleIntervals))
+	for i, iv := range CandleIntervals {
+		rows[i] = fmt.Sprintf("('%s', %d::float8)", iv, int64(candleDurations[iv].Seconds()))
+	}
+	return "(VALUES " + strings.Join(rows, ", ") + ")"
+}()
+
+// candleMergeSQL: Gộp nến mới vào nến đã có. Open/close theo trade id nên trade đến trễ (settle lại) vẫn đúng thứ tự.
+const candleMergeSQL = `
+	ON CONFLICT (symbol, period, open_time) DO UPDATE SET
+		open = CASE WHEN EXCLUDED.first_trade_id < candles.first_trade_id THEN EXCLUDED.open ELSE candles.open END,
+		high = GREATEST(candles.high, EXCLUDED.high),
+		low = LEAST(candles.low, EXCLUDED.low),
+		close = CASE WHEN EXCLUDED.last_trade_id > candles.last_trade_id THEN EXCLUDED.close ELSE candles.close END,
+		volume = candles.volume + EXCLUDED.volume,
+		trade_count = candles.trade_count + EXCLUDED.trade_count,
+		first_trade_id = LEAST(candles.first_trade_id, EXCLUDED.first_trade_id),
+		last_trade_id = GREATEST(candles.last_trade_id, EXCLUDED.last_trade_id)`
+
+// candleUpsertSQL: Gộp các trade của source (có id, symbol, price, amount, created_at; alias t, khung nến alias p)
+// thoả where thành nến của mọi khung, một dòng cho mỗi (symbol, khung, nến) rồi merge vào bảng candles.
+// Ghi theo thứ tự khoá để các transaction settle song song không deadlock trên cùng nến.
+func candleUpsertSQL(source, where string) string {
+	return `
+	INSERT INTO candles (symbol, period, open_time, open, high, low, close, volume, trade_count, first_trade_id, last_trade_id)
+	SELECT symbol, period, bucket,
+	       (array_agg(price ORDER BY id))[1], MAX(price), MIN(price), (array_agg(price ORDER BY id DESC))[1],
+	       SUM(amount), COUNT(*), MIN(id), MAX(id)
+	FROM (
+	    SELECT t.id, t.symbol, t.price, t.amount, p.period,
+	           to_timestamp(floor(extract(epoch FROM t.created_at) / p.seconds) * p.seconds) AT TIME ZONE 'UTC' AS bucket
+	    FROM ` + source + ` t
+	    CROSS JOIN ` + candlePeriodsSQL + ` AS p(period, seconds)
+	    WHERE ` + where + `
+	) b
+	GROUP BY symbol, period, bucket
+	ORDER BY symbol, period, bucket` + candleMergeSQL
+}
+
+// publishCandles: Đọc lại các nến mà SettleTrades vừa cập nhật trong transaction settle và đẩy ra (gọi sau khi commit)
+func (e *Engine) publishCandles(trades []Trade) {
+	type key struct {
+		symbol, period string
+		openTime       time.Time
+	}
+	seen := make(map[key]bool)
+	var symbols, periods []string
+	var openTimes []time.Time
+	for _, t := range trades {
+		for _, iv := range CandleIntervals {
+			k := key{t.Symbol, iv, t.CreatedAt.UTC().Truncate(candleDurations[iv])}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			symbols = append(symbols, k.symbol)
+			periods = append(periods, k.period)
+			openTimes = append(openTimes, k.openTime)
+		}
+	}
+	if len(symbols) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	rows, err := e.DB.Query(ctx,
+		`SELECT c.symbol, c.period, c.open_time, c.open, c.high, c.low, c.close, c.volume, c.trade_count
+		 FROM candles c
+		 JOIN unnest($1::varchar[], $2::varchar[], $3::timestamp[]) AS k(symbol, period, open_time)
+		   ON c.symbol = k.symbol AND c.period = k.period AND c.open_time = k.open_time
+		 ORDER BY c.open_time`,
+		symbols, periods, openTimes)
+	if err != nil {
+		// Nến trong DB đã đúng (cùng transaction với trades), chỉ mất update realtime
+		log.Printf("publishCandles: %v", err)
+		return
+	}
+	var updates []CandleUpdate
+	for rows.Next() {
+		var u CandleUpdate
+		var openTime time.Time
+		if err := rows.Scan(&u.Symbol, &u.Interval, &openTime, &u.Open, &u.High, &u.Low, &u.Close, &u.Volume, &u.Trades); err != nil {
+			log.Printf("publishCandles: %v", err)
+			rows.Close()
+			return
+		}
+		u.Time = openTime.UnixMilli()
+		updates = append(updates, u)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("publishCandles: %v", err)
+		return
+	}
+
+	now := time.Now()
+	e.live.mu.Lock()
+	defer e.live.mu.Unlock()
+	for _, u := range updates {
+		key := candleKey{u.Symbol, u.Interval}
+		cur, ok := e.live.candles[key]
+		switch {
+		case ok && u.Time < cur.Time:
+			// Trade settle trễ vào một khung cũ: DB đã đúng, chỉ gửi lại bản đã đóng của khung đó
+			u.Closed = true
+		case ok && u.Time == cur.Time && u.Trades < cur.Trades:
+			continue // Bản cũ hơn bản đã gửi (hai batch settle song song)
+		default:
+			e.live.candles[key] = u.Candle
+			if !time.UnixMilli(u.Time).Add(candleDurations[u.Interval]).After(now) {
+				continue // Khung đã hết: RunCandleTicker sẽ gửi bản "closed"
+			}
+		}
+		e.publishCandleLocked(u)
+	}
+}
+
+// RunCandleTicker: Mỗi giây đóng các nến đã hết khung (gửi bản "closed"), rồi mở nến phẳng
+// theo giá đóng cửa cho khung mới, giống cách ListCandles lấp khoảng trống.
+func (e *Engine) RunCandleTicker() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		e.closeCandles(now)
+	}
+}
+
+func (e *Engine) closeCandles(now time.Time) {
+	e.live.mu.Lock()
+	defer e.live.mu.Unlock()
+	for key, c := range e.live.candles {
+		d := candleDurations[key.interval]
+		current := now.UTC().Truncate(d).UnixMilli()
+		if c.Time >= current {
+			continue
+		}
+		e.publishCandleLocked(CandleUpdate{Symbol: key.symbol, Interval: key.interval, Closed: true, Candle: c})
+		p := c.Close
+		next := Candle{Time: current, Open: p, High: p, Low: p, Close: p}
+		e.live.candles[key] = next
+		e.publishCandleLocked(CandleUpdate{Symbol: key.symbol, Interval: key.interval, Candle: next})
+	}
+}
+
+// BackfillCandles: Dựng nến từ bảng trades cho các trade chưa có trong nến, tức trade settle trước khi có
+// bảng candles (trade mới được gộp vào nến ngay trong SettleTrades). Gọi lúc khởi động, trước RunSettlementWorker.
+func (e *Engine) BackfillCandles() error {
+	ctx := context.Background()
+	tag, err := e.DB.Exec(ctx, candleUpsertSQL("trades",
+		`t.symbol IS NOT NULL AND t.created_at IS NOT NULL
+		 AND t.id > (SELECT COALESCE(MAX(last_trade_id), 0) FROM candles WHERE period = p.period)`))
+	if err != nil {
+		return fmt.Errorf("backfill candles: %w", err)
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		log.Printf("BackfillCandles: %d candles updated", n)
+	}
+	return nil
+}
+
+// ListCandles: Nến của market theo thời gian tăng dần, tối đa limit nến (mặc định 100, tối đa 1000).
+// Có from: bắt đầu từ nến chứa from; không có: limit nến gần nhất kết thúc ở nến chứa to (hoặc nến hiện tại).
+// Khung không có trade được lấp bằng nến phẳng theo giá đóng cửa trước đó, volume 0.
+func ListCandles(db *pgxpool.Pool, symbol, interval string, from, to time.Time, limit int) ([]Candle, error) {
+	d, ok := candleDurations[interval]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported interval %q", ErrInvalidCandleQuery, interval)
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return nil, fmt.Errorf("%w: start_time must be before end_time", ErrInvalidCandleQuery)
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	// Khoảng [first, last] theo thời điểm mở nến, không vượt quá nến hiện tại
+	last := time.Now().UTC().Truncate(d)
+	if !to.IsZero() && to.UTC().Truncate(d).Before(last) {
+		last = to.UTC().Truncate(d)
+	}
+	first := last.Add(-time.Duration(limit-1) * d)
+	if !from.IsZero() {
+		first = from.UTC().Truncate(d)
+		if end := first.Add(time.Duration(limit-1) * d); end.Before(last) {
+			last = end
+		}
+	}
+	candles := make([]Candle, 0)
+	if last.Before(first) {
+		return candles, nil
+	}
+
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT open_time, open, high, low, close, volume, trade_count
+		 FROM candles
+		 WHERE symbol = $1 AND period = $2 AND open_time BETWEEN $3 AND $4
+		 ORDER BY open_time`,
+		symbol, interval, first, last)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[int64]Candle)
+	for rows.Next() {
+		var openTime time.Time
+		var c Candle
+		if err := rows.Scan(&openTime, &c.Open, &c.High, &c.Low, &c.Close, &c.Volume, &c.Trades); err != nil {
+			return nil, err
+		}
+		c.Time = openTime.UnixMilli()
+		stored[c.Time] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Giá đóng cửa của nến gần nhất trước khoảng, để lấp các khung trống ở đầu
+	var prevClose *float64
+	err = db.QueryRow(ctx,
+		`SELECT close FROM candles
+		 WHERE symbol = $1 AND period = $2 AND open_time < $3
+		 ORDER BY open_time DESC LIMIT 1`,
+		symbol, interval, first).Scan(&prevClose)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	for t := first; !t.After(last); t = t.Add(d) {
+		if c, ok := stored[t.UnixMilli()]; ok {
+			candles = append(candles, c)
+			prevClose = &c.Close
+			continue
+		}
+		if prevClose == nil {
+			continue // Chưa có trade nào trước khung này
+		}
+		p := *prevClose
+		candles = append(candles, Candle{Time: t.UnixMilli(), Open: p, High: p, Low: p, Close: p})
+	}
+	return candles, nil
+}
@@ -0,0 +1,92 @@
+package engine
+
+// DepthSnapshot: Sổ lệnh gộp theo mức giá tại LastUpdateID
+type DepthSnapshot struct {
+	Symbol       string       `json:"symbol"`
+	LastUpdateID int64        `json:"lastUpdateId"`
+	Bids         []PriceLevel `json:"bids"`
+	Asks         []PriceLevel `json:"asks"`
+}
+
+// DepthUpdate: Các mức giá thay đổi trong các update FirstUpdateID..LastUpdateID.
+// Client giữ sổ cục bộ: bỏ diff có LastUpdateID <= lastUpdateId của snapshot,
+// diff tiếp theo phải có FirstUpdateID = LastUpdateID trước đó + 1, nếu không thì lấy lại snapshot.
+type DepthUpdate struct {
+	Symbol        string       `json:"symbol"`
+	FirstUpdateID int64        `json:"firstUpdateId"`
+	LastUpdateID  int64        `json:"lastUpdateId"`
+	Bids          []PriceLevel `json:"bids"`
+	Asks          []PriceLevel `json:"asks"`
+}
+
+// depthLevel: Một mức giá bị thay đổi (side là bên của lệnh trên sổ)
+type depthLevel struct {
+	side  string
+	price float64
+}
+
+// DepthSnapshot: Tối đa limit mức giá mỗi bên (limit <= 0: lấy hết)
+func (e *Engine) DepthSnapshot(symbol string, limit int) (*DepthSnapshot, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ob, ok := e.OrderBooks[symbol]
+	if !ok {
+		return nil, ErrSymbolNotFound
+	}
+	bids, asks := ob.Depth(limit)
+	return &DepthSnapshot{Symbol: symbol, LastUpdateID: ob.UpdateID, Bids: bids, Asks: asks}, nil
+}
+
+// OnDepthUpdate: Đăng ký hàm nhận DepthUpdate, cùng quy ước với OnBalanceUpdate.
+// Hàm được gọi khi đang giữ e.mu để các diff đi ra đúng thứ tự update ID.
+func (e *Engine) OnDepthUpdate(fn func(DepthUpdate)) {
+	e.depthHandlers = append(e.depthHandlers, fn)
+}
+
+// publishDepthLocked: Tăng UpdateID của sổ và báo số lượng mới của các mức giá bị thay đổi (caller giữ e.mu)
+func (e *Engine) publishDepthLocked(ob *OrderBook, touched []depthLevel) {
+	ob.UpdateID++
+	if len(e.depthHandlers) == 0 {
+		return
+	}
+
+	u := DepthUpdate{
+		Symbol:        ob.Symbol,
+		FirstUpdateID: ob.UpdateID,
+		LastUpdateID:  ob.UpdateID,
+		Bids:          make([]PriceLevel, 0),
+		Asks:          make([]PriceLevel, 0),
+	}
+	seen := make(map[depthLevel]bool)
+	for _, l := range touched {
+		if seen[l] {
+			continue
+		}
+		seen[l] = true
+		level := PriceLevel{Price: l.price, Amount: ob.levelAmount(l.side, l.price)}
+		if l.side == "BUY" {
+			u.Bids = append(u.Bids, level)
+		} else {
+			u.Asks = append(u.Asks, level)
+		}
+	}
+	for _, fn := range e.depthHandlers {
+		fn(u)
+	}
+}
+
+// matchDepthLevels: Các mức giá thay đổi sau khi khớp order (rest != nil nghĩa là phần dư đã nằm trên sổ)
+func matchDepthLevels(order *Order, trades []Trade, rest *Order) []depthLevel {
+	makerSide := "BUY"
+	if order.Side == "BUY" {
+		makerSide = "SELL"
+	}
+	levels := make([]depthLevel, 0, len(trades)+1)
+	for _, t := range trades {
+		levels = append(levels, depthLevel{makerSide, t.Price})
+	}
+	if rest != nil {
+		levels = append(levels, depthLevel{order.Side, order.Price})
+	}
+	return levels
+}
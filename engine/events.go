@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// Các sự kiện trong vòng đời lệnh gửi cho chủ lệnh
+const (
+	OrderAccepted        = "ACCEPTED"         // Đã khoá tiền và đưa vào khớp lệnh
+	OrderPartiallyFilled = "PARTIALLY_FILLED" // Đã settle một phần
+	OrderFilled          = "FILLED"           // Đã settle hết
+	OrderCancelled       = "CANCELLED"
+	OrderRejected        = "REJECTED" // Bị từ chối trước khi khoá tiền (không có ID)
+)
+
+// OrderEvent: Trạng thái lệnh tại thời điểm xảy ra sự kiện
+type OrderEvent struct {
+	Event  string    `json:"event"`
+	Order  OrderInfo `json:"order"`
+	Reason string    `json:"reason,omitempty"` // Lý do khi REJECTED
+}
+
+// FillEvent: Một lần khớp đã settle, nhìn từ phía UserID (mỗi trade tạo 2 FillEvent)
+type FillEvent struct {
+	UserID int `json:"user_id"`
+	UserTrade
+}
+
+// PublicTrade: Trade công khai (không có thông tin user/order)
+type PublicTrade struct {
+	ID        int64     `json:"id"`
+	Symbol    string    `json:"symbol"`
+	Price     float64   `json:"price"`
+	Amount    float64   `json:"amount"`
+	TakerSide string    `json:"taker_side"` // Bên chủ động khớp (aggressor)
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (t Trade) public() PublicTrade {
+	return PublicTrade{ID: t.ID, Symbol: t.Symbol, Price: t.Price, Amount: t.Amount, TakerSide: t.TakerSide, CreatedAt: t.CreatedAt}
+}
+
+// OnTrade: Đăng ký hàm nhận từng trade sau khi settle, cùng quy ước với OnBalanceUpdate
+func (e *Engine) OnTrade(fn func(PublicTrade)) {
+	e.tradeHandlers = append(e.tradeHandlers, fn)
+}
+
+// OnOrderEvent / OnFill: Đăng ký hàm nhận sự kiện, cùng quy ước với OnBalanceUpdate
+func (e *Engine) OnOrderEvent(fn func(OrderEvent)) {
+	e.orderHandlers = append(e.orderHandlers, fn)
+}
+
+func (e *Engine) OnFill(fn func(FillEvent)) {
+	e.fillHandlers = append(e.fillHandlers, fn)
+}
+
+func (e *Engine) publishOrderEvent(ev OrderEvent) {
+	for _, fn := range e.orderHandlers {
+		fn(ev)
+	}
+}
+
+// isOrderRejection: Lỗi do lệnh không hợp lệ với trạng thái tài khoản/market (không phải lỗi hệ thống)
+func isOrderRejection(err error) bool {
+	for _, target := range []error{ErrInvalidOrder, ErrInvalidClientOrderID, ErrSymbolNotFound, ErrMarketHalted, ErrInsufficientBalance, ErrAccountFrozen} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishSettled: Sau khi một hoặc một nhóm batch settle xong: nến, trade công khai, fill của từng bên, trạng thái mới của các lệnh, rồi số dư
+func (e *Engine) publishSettled(trades []Trade) {
+	e.publishCandles(trades)
+	for _, t := range trades {
+		for _, fn := range e.tradeHandlers {
+			fn(t.public())
+		}
+	}
+
+	if len(e.fillHandlers) > 0 {
+		for _, t := range trades {
+			makerSide := "BUY"
+			if t.TakerSide == "BUY" {
+				makerSide = "SELL"
+			}
+			fills := []FillEvent{
+				{t.MakerUserID, UserTrade{
+					TradeID: t.ID, Symbol: t.Symbol, OrderID: t.MakerOrderID, CounterOrderID: t.TakerOrderID,
+					Side: makerSide, Role: "MAKER", Price: t.Price, Amount: t.Amount,
+					Fee: t.MakerFee, FeeAsset: feeAsset(t.Symbol, makerSide), CreatedAt: t.CreatedAt,
+				}},
+				{t.TakerUserID, UserTrade{
+					TradeID: t.ID, Symbol: t.Symbol, OrderID: t.TakerOrderID, CounterOrderID: t.MakerOrderID,
+					Side: t.TakerSide, Role: "TAKER", Price: t.Price, Amount: t.Amount,
+					Fee: t.TakerFee, FeeAsset: feeAsset(t.Symbol, t.TakerSide), CreatedAt: t.CreatedAt,
+				}},
+			}
+			for _, f := range fills {
+				for _, fn := range e.fillHandlers {
+					fn(f)
+				}
+			}
+		}
+	}
+
+	if len(e.orderHandlers) > 0 {
+		e.publishOrderFills(trades)
+	}
+	e.publishBalances(tradeBalanceKeys(trades))
+}
+
+// publishOrderFills: Đọc lại các lệnh có trong batch và báo PARTIALLY_FILLED / FILLED
+func (e *Engine) publishOrderFills(trades []Trade) {
+	seen := make(map[int]bool)
+	ids := make([]int, 0, 2*len(trades))
+	for _, t := range trades {
+		for _, id := range []int{t.MakerOrderID, t.TakerOrderID} {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	ctx := context.Background()
+	rows, err := e.DB.Query(ctx,
+		`SELECT `+orderColumns+` FROM orders WHERE id = ANY($1) ORDER BY id`, ids)
+	if err != nil {
+		log.Printf("publishOrderFills: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var events []OrderEvent
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			log.Printf("publishOrderFills: %v", err)
+			return
+		}
+		switch o.Status {
+		case "PARTIAL":
+			events = append(events, OrderEvent{Event: OrderPartiallyFilled, Order: *o})
+		case "FILLED":
+			events = append(events, OrderEvent{Event: OrderFilled, Order: *o})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("publishOrderFills: %v", err)
+		return
+	}
+	for _, ev := range events {
+		e.publishOrderEvent(ev)
+	}
+}
+
+// rejectedOrder: Lệnh bị từ chối chưa được lưu nên không có ID
+func rejectedOrder(userID int, symbol, side string, price, amount float64, clientOrderID string) OrderInfo {
+	return OrderInfo{
+		ClientOrderID: clientOrderID,
+		UserID:        userID,
+		Symbol:        symbol,
+		Side:          side,
+		Price:         price,
+		Amount:        amount,
+		Status:        OrderRejected,
+		CreatedAt:     time.Now(),
+	}
+}
@@ -0,0 +1,47 @@
+package engine
+
+// Phí giao dịch theo tỉ lệ giá trị khớp. Phí trừ vào tài sản người đó nhận về:
+// bên mua trả phí bằng base (BTC), bên bán trả phí bằng quote (USDT).
+// Phí thu được cộng vào available của tài khoản thu phí FeeAccountUserID khi settle.
+const (
+	MakerFeeRate = 0.001 // 0.1% cho lệnh treo sẵn trên sổ
+	TakerFeeRate = 0.002 // 0.2% cho lệnh chủ động khớp
+)
+
+// FeeAccountUserID: Tài khoản hệ thống nhận phí giao dịch (seed trong init.sql với id cố định, không đăng nhập được)
+const FeeAccountUserID = 0
+
+// feeDecimals: Phí làm tròn theo 8 chữ số của DECIMAL(20,8) để phần người dùng mất đúng bằng phần sàn nhận
+const feeDecimals = PriceDecimals + AmountDecimals
+
+// applyFees: Tính phí maker/taker cho từng trade vừa khớp
+func applyFees(trades []Trade) {
+	for i := range trades {
+		t := &trades[i]
+		cost := t.Price * t.Amount
+		if t.TakerSide == "BUY" {
+			t.TakerFee = roundDecimals(t.Amount*TakerFeeRate, feeDecimals) // Taker mua -> nhận base
+			t.MakerFee = roundDecimals(cost*MakerFeeRate, feeDecimals)     // Maker bán -> nhận quote
+		} else {
+			t.TakerFee = roundDecimals(cost*TakerFeeRate, feeDecimals)
+			t.MakerFee = roundDecimals(t.Amount*MakerFeeRate, feeDecimals)
+		}
+	}
+}
+
+// feeAsset: Tài sản dùng để trả phí của bên side trong market symbol
+func feeAsset(symbol, side string) string {
+	base, quote := splitSymbol(symbol)
+	if side == "BUY" {
+		return base
+	}
+	return quote
+}
+
+// buyerSellerFees: Phí của bên mua (base) và bên bán (quote) trong trade
+func (t Trade) buyerSellerFees() (buyerFee, sellerFee float64) {
+	if t.TakerSide == "BUY" {
+		return t.TakerFee, t.MakerFee
+	}
+	return t.MakerFee, t.TakerFee
+}
@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Các loại bút toán ghi vào bảng ledger_entries
+const (
+	LedgerWithdrawalHold    = "WITHDRAWAL_HOLD"    // Giữ tiền khi tạo lệnh rút
+	LedgerWithdrawalRelease = "WITHDRAWAL_RELEASE" // Trả lại tiền khi lệnh rút bị từ chối/huỷ
+	LedgerWithdrawal        = "WITHDRAWAL"         // Tiền đã rút ra khỏi sàn
+	LedgerTransferOut       = "TRANSFER_OUT"       // Chuyển nội bộ: bên gửi
+	LedgerTransferIn        = "TRANSFER_IN"        // Chuyển nội bộ: bên nhận
+	LedgerAdjustment        = "ADJUSTMENT"         // Điều chỉnh thủ công đã được duyệt
+)
+
+// addLedgerEntry: Cập nhật balances và ghi bút toán tương ứng trong cùng transaction.
+// Caller phải đã khoá dòng balance (FOR UPDATE) trước khi gọi.
+func addLedgerEntry(ctx context.Context, tx pgx.Tx, userID int, asset string, availableDelta, lockedDelta float64, entryType string, refID int) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE balances
+		 SET available = available + $1,
+		     locked = locked + $2
+		 WHERE user_id=$3 AND asset_symbol=$4`,
+		availableDelta, lockedDelta, userID, asset)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO ledger_entries (user_id, asset_symbol, available_delta, locked_delta, entry_type, ref_id)
+		 VALUES ($1,$2,$3,$4,$5,$6)`,
+		userID, asset, availableDelta, lockedDelta, entryType, refID)
+	return err
+}
@@ -1,9 +1,10 @@
 package engine
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -12,41 +13,149 @@ import (
 type Engine struct {
 	DB         *pgxpool.Pool
 	OrderBooks map[string]*OrderBook
+
+	mu     sync.Mutex        // Bảo vệ OrderBooks và halted
+	halted map[string]string // symbol -> lý do tạm dừng giao dịch
+
+	lastPrices map[string]float64 // symbol -> giá khớp gần nhất trên RAM
+
+	balanceHandlers []func(BalanceUpdate) // Xem OnBalanceUpdate
+	orderHandlers   []func(OrderEvent)
+	fillHandlers    []func(FillEvent)
+	depthHandlers   []func(DepthUpdate)
+	tradeHandlers   []func(PublicTrade)
+	candleHandlers  []func(CandleUpdate)
+
+	live liveCandles // Xem publishCandles
 }
 
+var (
+	ErrSymbolNotFound = errors.New("symbol not found")
+	ErrMarketHalted   = errors.New("market is halted")
+)
+
 func NewEngine(db *pgxpool.Pool) *Engine {
 	books := make(map[string]*OrderBook)
 	books["BTC_USDT"] = NewOrderBook("BTC_USDT")
-	return &Engine{
+	e := &Engine{
 		DB:         db,
 		OrderBooks: books,
+		halted:     make(map[string]string),
+		lastPrices: make(map[string]float64),
+		live:       liveCandles{candles: make(map[candleKey]Candle)},
 	}
+	return e
 }
 
-// PlaceOrder: Hàm Entrypoint
-func (e *Engine) PlaceOrder(userID int, symbol string, side string, price, amount float64) error {
-	// 1. Validate & Lock tiền (Gọi hàm từ file accounting.go cùng package)
-	// Lưu ý: Bạn cần sửa accounting.go để hàm trả về orderID thay vì chỉ error
-    // Giả sử hàm CreateOrder trả về (int, error)
-    var orderID int
-    var err error
-    
-    if side == "BUY" {
-        orderID, err = CreateBuyOrder(e.DB, userID, symbol, price, amount)
-    } else {
-        orderID, err = CreateSellOrder(e.DB, userID, symbol, price, amount)
-    }
-    
-	if err != nil {
-		return fmt.Errorf("accounting error: %v", err)
+// HasSymbol: Market có tồn tại không
+func (e *Engine) HasSymbol(symbol string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.OrderBooks[symbol]
+	return ok
+}
+
+// Ticker: Giá tốt nhất hai bên và giá khớp gần nhất (0 nếu chưa có)
+type Ticker struct {
+	Symbol    string  `json:"symbol"`
+	BestBid   float64 `json:"best_bid"`
+	BestAsk   float64 `json:"best_ask"`
+	LastPrice float64 `json:"last_price"`
+}
+
+func (e *Engine) Ticker(symbol string) (*Ticker, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ob, ok := e.OrderBooks[symbol]
+	if !ok {
+		return nil, ErrSymbolNotFound
+	}
+	t := &Ticker{Symbol: symbol, LastPrice: e.lastPrices[symbol]}
+	if len(ob.Bids) > 0 {
+		t.BestBid = ob.Bids[0].Price
 	}
+	if len(ob.Asks) > 0 {
+		t.BestAsk = ob.Asks[0].Price
+	}
+	return t, nil
+}
 
-	// 2. Khớp lệnh trên RAM
+// PlaceOrder: Hàm Entrypoint.
+// clientOrderID (tuỳ chọn) là khoá idempotency theo user: gửi lại cùng ID sẽ trả về lệnh gốc thay vì đặt lệnh mới.
+func (e *Engine) PlaceOrder(userID int, symbol string, side string, price, amount float64, clientOrderID string) (*PlaceOrderResult, error) {
+	res, err := e.placeOrder(userID, symbol, side, price, amount, clientOrderID)
+	if err != nil && isOrderRejection(err) {
+		e.publishOrderEvent(OrderEvent{
+			Event:  OrderRejected,
+			Order:  rejectedOrder(userID, symbol, side, price, amount, clientOrderID),
+			Reason: err.Error(),
+		})
+	}
+	return res, err
+}
+
+func (e *Engine) placeOrder(userID int, symbol string, side string, price, amount float64, clientOrderID string) (*PlaceOrderResult, error) {
+	// Làm tròn theo PriceDecimals/AmountDecimals trước khi khoá tiền và khớp lệnh
+	price, amount = quantizePrice(price), quantizeAmount(amount)
+	if err := validateOrderParams(side, price, amount); err != nil {
+		return nil, err
+	}
+	if err := ValidateClientOrderID(clientOrderID); err != nil {
+		return nil, err
+	}
+	if clientOrderID != "" {
+		if existing, err := GetOrderByClientID(e.DB, userID, clientOrderID); err == nil {
+			if !sameOrderParams(existing, symbol, side, price, amount) {
+				return nil, ErrClientOrderIDConflict
+			}
+			res := newPlaceOrderResult(existing, 0, nil)
+			res.Duplicate = true
+			return res, nil
+		} else if !errors.Is(err, ErrOrderNotFound) {
+			return nil, err
+		}
+	}
+
+	// 0. Kiểm tra market tồn tại và không bị tạm dừng trước khi khoá tiền
+	e.mu.Lock()
 	ob, ok := e.OrderBooks[symbol]
+	reason, halted := e.halted[symbol]
+	e.mu.Unlock()
 	if !ok {
-		return fmt.Errorf("symbol not found")
+		return nil, ErrSymbolNotFound
+	}
+	if halted {
+		return nil, fmt.Errorf("%w: %s", ErrMarketHalted, reason)
+	}
+
+	// 1. Validate & Lock tiền (Gọi hàm từ file accounting.go cùng package)
+	var orderID int
+	var err error
+
+	if side == "BUY" {
+		orderID, err = CreateBuyOrder(e.DB, userID, symbol, price, amount, clientOrderID)
+	} else {
+		orderID, err = CreateSellOrder(e.DB, userID, symbol, price, amount, clientOrderID)
+	}
+
+	if errors.Is(err, errDuplicateClientOrderID) {
+		// Hai request cùng client_order_id chạy song song: request thua trả về lệnh của request thắng
+		existing, err := GetOrderByClientID(e.DB, userID, clientOrderID)
+		if err != nil {
+			return nil, err
+		}
+		if !sameOrderParams(existing, symbol, side, price, amount) {
+			return nil, ErrClientOrderIDConflict
+		}
+		res := newPlaceOrderResult(existing, 0, nil)
+		res.Duplicate = true
+		return res, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("accounting error: %w", err)
 	}
 
+	// 2. Khớp lệnh trên RAM
 	order := &Order{
 		ID:        orderID,
 		UserID:    userID,
@@ -56,105 +165,62 @@ func (e *Engine) PlaceOrder(userID int, symbol string, side string, price, amoun
 		Filled:    0,
 		Timestamp: time.Now().UnixNano(),
 	}
+	e.publishOrderEvent(OrderEvent{Event: OrderAccepted, Order: OrderInfo{
+		ID:            orderID,
+		ClientOrderID: clientOrderID,
+		UserID:        userID,
+		Symbol:        symbol,
+		Side:          side,
+		Price:         price,
+		Amount:        amount,
+		Status:        "OPEN",
+		CreatedAt:     time.Unix(0, order.Timestamp),
+	}})
+	e.publishBalances([]balanceKey{{userID, lockedAsset(symbol, side)}})
+
+	e.mu.Lock()
+	// Lệnh đã commit trước khi lấy lock: nếu bị huỷ trong khoảng đó (tiền đã hoàn) thì không được đưa vào khớp
+	placed, err := GetOrder(e.DB, userID, orderID)
+	if err != nil || placed.Status == "CANCELLED" {
+		e.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return newPlaceOrderResult(placed, 0, nil), nil
+	}
+	trades, rest := ob.Process(order)
+	applyFees(trades)
+	if len(trades) > 0 {
+		e.lastPrices[symbol] = trades[len(trades)-1].Price
+	}
+	e.publishDepthLocked(ob, matchDepthLevels(order, trades, rest))
+	filled := order.Filled // Chụp lại trước khi nhả lock, sau đó lệnh có thể tiếp tục bị khớp
 
-	trades, _ := ob.Process(order)
-
-	// 3. Settlement (Nếu có khớp)
+	// 3. Ghi trades vào hàng đợi settlement trước (bền vững trên DB) rồi mới settle.
+	// Giữ lock để thứ tự các batch trong hàng đợi đúng với thứ tự khớp lệnh.
+	var batchID int64
 	if len(trades) > 0 {
-		err := e.Settlement(trades)
+		batchID, err = e.enqueueSettlement(symbol, trades)
 		if err != nil {
-			log.Printf("CRITICAL: Settlement failed for trades %v: %v", trades, err)
-            // Trong thực tế, cần log vào bảng 'errors' để admin xử lý bằng tay
+			// Sổ lệnh trên RAM đã thay đổi nhưng không lưu được trades -> dừng market để admin xử lý
+			log.Printf("CRITICAL: Cannot persist settlement batch for trades %v: %v", trades, err)
+			e.haltLocked(symbol, "settlement queue unavailable")
+		}
+	}
+	e.mu.Unlock()
+
+	// 4. Settle ngay; nếu lỗi thì worker sẽ thử lại theo backoff
+	if batchID != 0 {
+		if err := e.settleBatch(batchID); err != nil {
+			log.Printf("Settlement batch #%d failed, will retry: %v", batchID, err)
 		} else {
-            log.Printf("Matched %d trades", len(trades))
-        }
+			log.Printf("Matched %d trades", len(trades))
+		}
 	}
-	return nil
-}
 
-// Settlement: Xử lý tiền sau khớp lệnh
-func (e *Engine) Settlement(trades []Trade) error {
-	ctx := context.Background()
-	tx, err := e.DB.Begin(ctx)
+	placed, err = GetOrder(e.DB, userID, orderID)
 	if err != nil {
-		return err
-	}
-	defer tx.Rollback(ctx)
-
-	for _, t := range trades {
-		// A. Lưu Trade History
-		_, err := tx.Exec(ctx,
-			`INSERT INTO trades (maker_order_id, taker_order_id, price, amount) 
-             VALUES ($1, $2, $3, $4)`,
-			t.MakerOrderID, t.TakerOrderID, t.Price, t.Amount)
-		if err != nil { return err }
-
-		// B. Update Trạng thái Orders (Maker & Taker)
-		// Update Maker
-		_, err = tx.Exec(ctx,
-			`UPDATE orders SET filled = filled + $1,
-			 status = CASE WHEN filled + $1 >= amount THEN 'FILLED' ELSE 'PARTIAL' END
-			 WHERE id = $2`, t.Amount, t.MakerOrderID)
-		if err != nil { return err }
-
-		// Update Taker
-		_, err = tx.Exec(ctx,
-			`UPDATE orders SET filled = filled + $1,
-			 status = CASE WHEN filled + $1 >= amount THEN 'FILLED' ELSE 'PARTIAL' END
-			 WHERE id = $2`, t.Amount, t.TakerOrderID)
-		if err != nil { return err }
-
-		// C. CHUYỂN TIỀN (Phần quan trọng nhất)
-        // Cần lấy UserID của Maker và Taker để cộng tiền
-        var makerID, takerID int
-        var makerSide string
-        
-        // Lấy thông tin Maker (để biết ai mua ai bán)
-        err = tx.QueryRow(ctx, "SELECT user_id, side FROM orders WHERE id=$1", t.MakerOrderID).Scan(&makerID, &makerSide)
-        if err != nil { return err }
-        
-        // Lấy thông tin Taker
-        err = tx.QueryRow(ctx, "SELECT user_id FROM orders WHERE id=$1", t.TakerOrderID).Scan(&takerID)
-        if err != nil { return err }
-
-        // Logic chuyển tiền:
-        // Tiền bị LOCK (Locked) đã bị trừ khỏi Available lúc đặt lệnh rồi.
-        // Giờ ta chỉ cần: Trừ Locked của người bán -> Cộng Available người mua.
-        
-        costUSDT := t.Price * t.Amount
-        amountBTC := t.Amount
-
-        if makerSide == "BUY" {
-            // Maker là người MUA (đã lock USDT), Taker là người BÁN (đã lock BTC)
-            
-            // 1. Maker (Mua): Trừ USDT Locked (đã dùng) -> Nhận BTC Available
-            _, err = tx.Exec(ctx, `UPDATE balances SET locked = locked - $1 WHERE user_id=$2 AND asset_symbol='USDT'`, costUSDT, makerID)
-            if err != nil { return err }
-            _, err = tx.Exec(ctx, `UPDATE balances SET available = available + $1 WHERE user_id=$2 AND asset_symbol='BTC'`, amountBTC, makerID)
-            if err != nil { return err }
-
-            // 2. Taker (Bán): Trừ BTC Locked (đã bán) -> Nhận USDT Available
-            _, err = tx.Exec(ctx, `UPDATE balances SET locked = locked - $1 WHERE user_id=$2 AND asset_symbol='BTC'`, amountBTC, takerID)
-            if err != nil { return err }
-            _, err = tx.Exec(ctx, `UPDATE balances SET available = available + $1 WHERE user_id=$2 AND asset_symbol='USDT'`, costUSDT, takerID)
-            if err != nil { return err }
-
-        } else { // makerSide == "SELL"
-            // Maker là người BÁN (đã lock BTC), Taker là người MUA (đã lock USDT)
-
-            // 1. Maker (Bán): Trừ BTC Locked -> Nhận USDT Available
-            _, err = tx.Exec(ctx, `UPDATE balances SET locked = locked - $1 WHERE user_id=$2 AND asset_symbol='BTC'`, amountBTC, makerID)
-            if err != nil { return err }
-             _, err = tx.Exec(ctx, `UPDATE balances SET available = available + $1 WHERE user_id=$2 AND asset_symbol='USDT'`, costUSDT, makerID)
-            if err != nil { return err }
-
-            // 2. Taker (Mua): Trừ USDT Locked -> Nhận BTC Available
-            _, err = tx.Exec(ctx, `UPDATE balances SET locked = locked - $1 WHERE user_id=$2 AND asset_symbol='USDT'`, costUSDT, takerID)
-            if err != nil { return err }
-            _, err = tx.Exec(ctx, `UPDATE balances SET available = available + $1 WHERE user_id=$2 AND asset_symbol='BTC'`, amountBTC, takerID)
-            if err != nil { return err }
-        }
-	}
-
-	return tx.Commit(ctx)
-}
\ No newline at end of file
+		return nil, err
+	}
+	return newPlaceOrderResult(placed, filled, trades), nil
+}
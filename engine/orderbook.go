@@ -1,15 +1,32 @@
 package engine
 
 import (
+	"math"
 	"sort"
 	"time"
 )
 
+// Số chữ số thập phân của giá (quote) và số lượng (base). Tổng không vượt quá 8 chữ số của DECIMAL(20,8)
+// nên price*amount (tiền khoá khi mua, từng phần khi settle, phần hoàn lại) luôn lưu chính xác trong DB:
+// tổng các lần settle từng phần đúng bằng số đã khoá, locked không bị âm vì sai số làm tròn.
+const (
+	PriceDecimals  = 2
+	AmountDecimals = 6
+)
+
+func roundDecimals(x float64, decimals int) float64 {
+	p := math.Pow10(decimals)
+	return math.Round(x*p) / p
+}
+
+func quantizePrice(price float64) float64   { return roundDecimals(price, PriceDecimals) }
+func quantizeAmount(amount float64) float64 { return roundDecimals(amount, AmountDecimals) }
+
 // Order đại diện cho lệnh đang nằm trên RAM
 type Order struct {
 	ID        int
 	UserID    int
-	Side      string  // "BUY" or "SELL"
+	Side      string // "BUY" or "SELL"
 	Price     float64
 	Amount    float64 // Số lượng ban đầu
 	Filled    float64 // Số lượng đã khớp
@@ -18,17 +35,32 @@ type Order struct {
 
 // OrderBook chứa 2 danh sách lệnh
 type OrderBook struct {
-	Symbol string
-	Bids   []*Order // Mua: Giá cao xếp trước
-	Asks   []*Order // Bán: Giá thấp xếp trước
+	Symbol   string
+	Bids     []*Order // Mua: Giá cao xếp trước
+	Asks     []*Order // Bán: Giá thấp xếp trước
+	UpdateID int64    // Tăng 1 mỗi lần sổ thay đổi (xem publishDepthLocked)
+}
+
+// PriceLevel: Tổng số lượng còn lại tại một mức giá. Trong diff, Amount = 0 nghĩa là mức giá đã hết.
+type PriceLevel struct {
+	Price  float64 `json:"price"`
+	Amount float64 `json:"amount"`
 }
 
 // Trade ghi lại kết quả khớp lệnh để lưu xuống DB sau này
 type Trade struct {
-	MakerOrderID int     // Lệnh đang nằm chờ (bị khớp)
-	TakerOrderID int     // Lệnh mới bay vào (chủ động khớp)
+	ID           int64 // Cấp từ trades_id_seq khi đưa vào hàng đợi settlement
+	Symbol       string
+	MakerOrderID int // Lệnh đang nằm chờ (bị khớp)
+	TakerOrderID int // Lệnh mới bay vào (chủ động khớp)
+	MakerUserID  int // Mang theo để settlement không phải SELECT lại orders
+	TakerUserID  int
+	TakerSide    string  // "BUY" or "SELL" - bên Maker là phía ngược lại
+	TakerPrice   float64 // Giá limit của Taker (để hoàn phần USDT khoá dư khi mua được giá tốt hơn)
 	Price        float64
 	Amount       float64
+	MakerFee     float64 // Tính bằng tài sản maker nhận về (xem fees.go)
+	TakerFee     float64
 	CreatedAt    time.Time
 }
 
@@ -64,6 +96,56 @@ func (ob *OrderBook) AddOrder(o *Order) {
 	}
 }
 
+// RemoveOrder gỡ lệnh khỏi sổ (khi huỷ), trả về nil nếu lệnh không còn trên sổ
+func (ob *OrderBook) RemoveOrder(orderID int) *Order {
+	for _, side := range []*[]*Order{&ob.Bids, &ob.Asks} {
+		for i, o := range *side {
+			if o.ID == orderID {
+				*side = append((*side)[:i], (*side)[i+1:]...)
+				return o
+			}
+		}
+	}
+	return nil
+}
+
+// Depth gộp lệnh theo mức giá, tối đa limit mức mỗi bên (limit <= 0: lấy hết)
+func (ob *OrderBook) Depth(limit int) (bids, asks []PriceLevel) {
+	return aggregateLevels(ob.Bids, limit), aggregateLevels(ob.Asks, limit)
+}
+
+// aggregateLevels: orders đã sắp xếp theo giá nên các lệnh cùng giá nằm liền nhau
+func aggregateLevels(orders []*Order, limit int) []PriceLevel {
+	levels := make([]PriceLevel, 0)
+	for _, o := range orders {
+		n := len(levels)
+		if n > 0 && levels[n-1].Price == o.Price {
+			levels[n-1].Amount += o.Amount - o.Filled
+			continue
+		}
+		if limit > 0 && n == limit {
+			break
+		}
+		levels = append(levels, PriceLevel{Price: o.Price, Amount: o.Amount - o.Filled})
+	}
+	return levels
+}
+
+// levelAmount: Tổng số lượng còn lại tại mức giá price của một bên
+func (ob *OrderBook) levelAmount(side string, price float64) float64 {
+	orders := ob.Asks
+	if side == "BUY" {
+		orders = ob.Bids
+	}
+	var total float64
+	for _, o := range orders {
+		if o.Price == price {
+			total += o.Amount - o.Filled
+		}
+	}
+	return total
+}
+
 // Process xử lý một lệnh mới bay vào
 func (ob *OrderBook) Process(order *Order) ([]Trade, *Order) {
 	var trades []Trade
@@ -79,8 +161,8 @@ func (ob *OrderBook) Process(order *Order) ([]Trade, *Order) {
 			}
 
 			// Tính số lượng khớp (min của 2 bên)
-			qtyNeeded := order.Amount - order.Filled
-			qtyAvailable := bestAsk.Amount - bestAsk.Filled
+			qtyNeeded := quantizeAmount(order.Amount - order.Filled)
+			qtyAvailable := quantizeAmount(bestAsk.Amount - bestAsk.Filled)
 			tradeQty := qtyNeeded
 
 			if qtyAvailable < qtyNeeded {
@@ -89,16 +171,21 @@ func (ob *OrderBook) Process(order *Order) ([]Trade, *Order) {
 
 			// Ghi nhận trade
 			trades = append(trades, Trade{
+				Symbol:       ob.Symbol,
 				MakerOrderID: bestAsk.ID,
 				TakerOrderID: order.ID,
+				MakerUserID:  bestAsk.UserID,
+				TakerUserID:  order.UserID,
+				TakerSide:    order.Side,
+				TakerPrice:   order.Price,
 				Price:        bestAsk.Price, // Khớp theo giá của người treo lệnh (Maker)
 				Amount:       tradeQty,
 				CreatedAt:    time.Now(),
 			})
 
 			// Cập nhật số lượng đã khớp
-			bestAsk.Filled += tradeQty
-			order.Filled += tradeQty
+			bestAsk.Filled = quantizeAmount(bestAsk.Filled + tradeQty)
+			order.Filled = quantizeAmount(order.Filled + tradeQty)
 
 			// Nếu lệnh treo (Maker) đã khớp hết -> Xóa khỏi sổ
 			if bestAsk.Filled >= bestAsk.Amount {
@@ -121,8 +208,8 @@ func (ob *OrderBook) Process(order *Order) ([]Trade, *Order) {
 			}
 
 			// Tính toán số lượng khớp
-			qtyNeeded := order.Amount - order.Filled
-			qtyAvailable := bestBid.Amount - bestBid.Filled
+			qtyNeeded := quantizeAmount(order.Amount - order.Filled)
+			qtyAvailable := quantizeAmount(bestBid.Amount - bestBid.Filled)
 			tradeQty := qtyNeeded
 
 			if qtyAvailable < qtyNeeded {
@@ -131,15 +218,20 @@ func (ob *OrderBook) Process(order *Order) ([]Trade, *Order) {
 
 			// Ghi nhận Trade
 			trades = append(trades, Trade{
-				MakerOrderID: bestBid.ID,   // Người treo lệnh mua
-				TakerOrderID: order.ID,     // Mình (người bán)
+				Symbol:       ob.Symbol,
+				MakerOrderID: bestBid.ID, // Người treo lệnh mua
+				TakerOrderID: order.ID,   // Mình (người bán)
+				MakerUserID:  bestBid.UserID,
+				TakerUserID:  order.UserID,
+				TakerSide:    order.Side,
+				TakerPrice:   order.Price,
 				Price:        bestBid.Price, // Khớp theo giá người treo (Maker)
 				Amount:       tradeQty,
 				CreatedAt:    time.Now(),
 			})
 
-			bestBid.Filled += tradeQty
-			order.Filled += tradeQty
+			bestBid.Filled = quantizeAmount(bestBid.Filled + tradeQty)
+			order.Filled = quantizeAmount(order.Filled + tradeQty)
 
 			// Xóa lệnh mua nếu đã khớp hết
 			if bestBid.Filled >= bestBid.Amount {
@@ -156,4 +248,4 @@ func (ob *OrderBook) Process(order *Order) ([]Trade, *Order) {
 	// Nếu chạy hết vòng lặp mà lệnh vẫn chưa khớp hết -> Thêm phần dư vào sổ
 	ob.AddOrder(order)
 	return trades, order // order này sẽ được lưu vào RAM
-}
\ No newline at end of file
+}
@@ -0,0 +1,506 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrOrderNotFound          = errors.New("order not found")
+	ErrOrderNotCancellable    = errors.New("order cannot be cancelled")
+	ErrSettlementInProgress   = errors.New("order has trades waiting for settlement, try again shortly")
+	ErrInvalidClientOrderID   = errors.New("client_order_id must be 1-36 characters of letters, digits, '-' or '_'")
+	ErrInvalidOrderFilter     = errors.New("invalid order filter")
+	ErrInvalidAmend           = errors.New("amended price must be positive and amount greater than the filled quantity")
+	errDuplicateClientOrderID = errors.New("duplicate client order id")
+	ErrClientOrderIDConflict  = errors.New("client_order_id is already used by an order with different parameters")
+	ErrInvalidOrder           = errors.New("invalid order")
+)
+
+var clientOrderIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,36}$`)
+
+// OrderInfo: Trạng thái lệnh lưu trong DB (trả về cho client)
+type OrderInfo struct {
+	ID            int       `json:"id"`
+	ClientOrderID string    `json:"client_order_id,omitempty"`
+	UserID        int       `json:"user_id"`
+	Symbol        string    `json:"symbol"`
+	Side          string    `json:"side"`
+	Price         float64   `json:"price"`
+	Amount        float64   `json:"amount"`
+	Filled        float64   `json:"filled"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Fill: Một lần khớp của lệnh vừa đặt (lệnh vừa đặt luôn là taker)
+type Fill struct {
+	TradeID      int64     `json:"trade_id"`
+	MakerOrderID int       `json:"maker_order_id"`
+	Price        float64   `json:"price"`
+	Amount       float64   `json:"amount"`
+	Fee          float64   `json:"fee"`
+	FeeAsset     string    `json:"fee_asset"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// PlaceOrderResult: Duplicate = true nghĩa là client_order_id đã được dùng và đây là lệnh gốc
+// (khi đó không có Fills vì lệnh đã khớp từ request trước).
+type PlaceOrderResult struct {
+	OrderInfo
+	AvgPrice  float64 `json:"avg_price"` // Giá khớp trung bình, 0 nếu chưa khớp
+	Fee       float64 `json:"fee"`       // Tổng phí của các fills
+	FeeAsset  string  `json:"fee_asset,omitempty"`
+	Fills     []Fill  `json:"fills"`
+	Duplicate bool    `json:"duplicate,omitempty"`
+}
+
+// newPlaceOrderResult: Ghép trạng thái lệnh với các trade vừa khớp.
+// filled lấy theo sổ RAM vì trades có thể chưa settle xong xuống DB.
+func newPlaceOrderResult(order *OrderInfo, filled float64, trades []Trade) *PlaceOrderResult {
+	res := &PlaceOrderResult{OrderInfo: *order, Fills: make([]Fill, 0, len(trades))}
+	if order.Status != "CANCELLED" && filled > order.Filled {
+		res.Filled = filled
+		res.Status = "PARTIAL"
+		if filled >= order.Amount {
+			res.Status = "FILLED"
+		}
+	}
+
+	var notional, qty float64
+	for _, t := range trades {
+		f := Fill{
+			TradeID:      t.ID,
+			MakerOrderID: t.MakerOrderID,
+			Price:        t.Price,
+			Amount:       t.Amount,
+			Fee:          t.TakerFee,
+			FeeAsset:     feeAsset(t.Symbol, t.TakerSide),
+			CreatedAt:    t.CreatedAt,
+		}
+		res.Fills = append(res.Fills, f)
+		res.Fee += f.Fee
+		res.FeeAsset = f.FeeAsset
+		notional += t.Price * t.Amount
+		qty += t.Amount
+	}
+	if qty > 0 {
+		res.AvgPrice = notional / qty
+	}
+	return res
+}
+
+const orderColumns = `id, COALESCE(client_order_id, ''), user_id, symbol, side, price, amount, filled, status, created_at`
+
+func scanOrder(row pgx.Row) (*OrderInfo, error) {
+	var o OrderInfo
+	err := row.Scan(&o.ID, &o.ClientOrderID, &o.UserID, &o.Symbol, &o.Side,
+		&o.Price, &o.Amount, &o.Filled, &o.Status, &o.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrOrderNotFound
+		}
+		return nil, err
+	}
+	return &o, nil
+}
+
+// ValidateClientOrderID: Rỗng nghĩa là client không gửi, luôn hợp lệ
+func ValidateClientOrderID(clientOrderID string) error {
+	if clientOrderID != "" && !clientOrderIDPattern.MatchString(clientOrderID) {
+		return ErrInvalidClientOrderID
+	}
+	return nil
+}
+
+// validateOrderParams: Side phải đúng BUY/SELL (settlement dựa vào TakerSide để biết ai mua, ai bán),
+// giá và số lượng phải là số hữu hạn > 0
+func validateOrderParams(side string, price, amount float64) error {
+	if side != "BUY" && side != "SELL" {
+		return fmt.Errorf("%w: side must be BUY or SELL, got %q", ErrInvalidOrder, side)
+	}
+	if !(price > 0) || math.IsInf(price, 1) {
+		return fmt.Errorf("%w: price must be a positive number (at least %g)", ErrInvalidOrder, math.Pow10(-PriceDecimals))
+	}
+	if !(amount > 0) || math.IsInf(amount, 1) {
+		return fmt.Errorf("%w: amount must be a positive number (at least %g)", ErrInvalidOrder, math.Pow10(-AmountDecimals))
+	}
+	return nil
+}
+
+// mapClientOrderIDConflict: Vi phạm unique (user_id, client_order_id) -> lệnh trùng
+func mapClientOrderIDConflict(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_orders_client_order_id" {
+		return errDuplicateClientOrderID
+	}
+	return err
+}
+
+func GetOrder(db *pgxpool.Pool, userID, orderID int) (*OrderInfo, error) {
+	ctx := context.Background()
+	return scanOrder(db.QueryRow(ctx,
+		`SELECT `+orderColumns+` FROM orders WHERE id=$1 AND user_id=$2`,
+		orderID, userID))
+}
+
+// OrderFilter: Các trường rỗng/zero nghĩa là không lọc
+type OrderFilter struct {
+	Symbol   string
+	Side     string
+	Status   string
+	From     time.Time // created_at >= From
+	To       time.Time // created_at < To
+	BeforeID int       // Phân trang: chỉ lấy các lệnh có id < BeforeID
+	Limit    int
+}
+
+// openOrderStatuses: Lệnh còn nằm trên sổ
+var openOrderStatuses = []string{"OPEN", "PARTIAL"}
+
+func (f *OrderFilter) validate(allowedStatuses []string) error {
+	if f.Side != "" && f.Side != "BUY" && f.Side != "SELL" {
+		return fmt.Errorf("%w: side must be BUY or SELL", ErrInvalidOrderFilter)
+	}
+	if f.Status != "" && !slices.Contains(allowedStatuses, f.Status) {
+		return fmt.Errorf("%w: status must be one of %v", ErrInvalidOrderFilter, allowedStatuses)
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return fmt.Errorf("%w: start_time must be before end_time", ErrInvalidOrderFilter)
+	}
+	if f.Limit <= 0 || f.Limit > 500 {
+		f.Limit = 100
+	}
+	return nil
+}
+
+// ListOpenOrders: Lệnh OPEN/PARTIAL của user, mới nhất trước
+func ListOpenOrders(db *pgxpool.Pool, userID int, f OrderFilter) ([]OrderInfo, error) {
+	if err := f.validate(openOrderStatuses); err != nil {
+		return nil, err
+	}
+	statuses := openOrderStatuses
+	if f.Status != "" {
+		statuses = []string{f.Status}
+	}
+	return listOrders(db, userID, statuses, f)
+}
+
+// ListOrderHistory: Toàn bộ lệnh của user (kể cả đã khớp hết/đã huỷ), mới nhất trước
+func ListOrderHistory(db *pgxpool.Pool, userID int, f OrderFilter) ([]OrderInfo, error) {
+	if err := f.validate([]string{"OPEN", "PARTIAL", "FILLED", "CANCELLED"}); err != nil {
+		return nil, err
+	}
+	var statuses []string
+	if f.Status != "" {
+		statuses = []string{f.Status}
+	}
+	return listOrders(db, userID, statuses, f)
+}
+
+// listOrders: statuses rỗng nghĩa là mọi trạng thái. Phân trang theo id giảm dần
+// (dùng idx_orders_user / idx_orders_user_symbol / idx_orders_user_open).
+func listOrders(db *pgxpool.Pool, userID int, statuses []string, f OrderFilter) ([]OrderInfo, error) {
+	var from, to *time.Time
+	if !f.From.IsZero() {
+		from = &f.From
+	}
+	if !f.To.IsZero() {
+		to = &f.To
+	}
+
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT `+orderColumns+`
+		 FROM orders
+		 WHERE user_id = $1
+		   AND ($2 = '' OR symbol = $2)
+		   AND ($3 = '' OR side = $3)
+		   AND ($4::varchar[] IS NULL OR status = ANY($4))
+		   AND ($5::timestamp IS NULL OR created_at >= $5)
+		   AND ($6::timestamp IS NULL OR created_at < $6)
+		   AND ($7 = 0 OR id < $7)
+		 ORDER BY id DESC
+		 LIMIT $8`,
+		userID, f.Symbol, f.Side, statuses, from, to, f.BeforeID, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := make([]OrderInfo, 0)
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *o)
+	}
+	return orders, rows.Err()
+}
+
+func GetOrderByClientID(db *pgxpool.Pool, userID int, clientOrderID string) (*OrderInfo, error) {
+	ctx := context.Background()
+	return scanOrder(db.QueryRow(ctx,
+		`SELECT `+orderColumns+` FROM orders WHERE user_id=$1 AND client_order_id=$2`,
+		userID, clientOrderID))
+}
+
+// CancelOrder: Gỡ lệnh khỏi sổ trên RAM rồi hoàn phần tiền còn khoá.
+// Phần còn lại tính theo sổ RAM vì các trade vừa khớp có thể chưa settle xuống DB.
+func (e *Engine) CancelOrder(userID, orderID int) (*OrderInfo, error) {
+	order, err := GetOrder(e.DB, userID, orderID)
+	if err != nil {
+		return nil, err
+	}
+	cancelled, _, err := e.cancel(order)
+	return cancelled, err
+}
+
+// cancel: Huỷ order, trả về trạng thái sau khi huỷ và số lượng chưa khớp đã được hoàn tiền
+func (e *Engine) cancel(order *OrderInfo) (*OrderInfo, float64, error) {
+	userID, orderID := order.UserID, order.ID
+	if order.Status != "OPEN" && order.Status != "PARTIAL" {
+		return nil, 0, ErrOrderNotCancellable
+	}
+	remaining := order.Amount - order.Filled
+
+	e.mu.Lock()
+	ob, ok := e.OrderBooks[order.Symbol]
+	var onBook *Order
+	if ok {
+		onBook = ob.RemoveOrder(orderID)
+		if onBook != nil {
+			e.publishDepthLocked(ob, []depthLevel{{onBook.Side, onBook.Price}})
+		}
+	}
+	if onBook != nil {
+		e.mu.Unlock()
+		remaining = quantizeAmount(onBook.Amount - onBook.Filled)
+		err := cancelOrder(e.DB, orderID, userID, remaining)
+		if err != nil {
+			// Không huỷ được trên DB -> trả lệnh về sổ (Timestamp giữ nguyên nên không mất thứ tự ưu tiên)
+			e.mu.Lock()
+			ob.AddOrder(onBook)
+			e.publishDepthLocked(ob, []depthLevel{{onBook.Side, onBook.Price}})
+			e.mu.Unlock()
+			return nil, 0, err
+		}
+	} else {
+		// Lệnh không có trên RAM: hoặc vừa khớp hết nhưng chưa settle, hoặc là lệnh cũ từ trước khi restart,
+		// hoặc vừa commit nhưng placeOrder chưa đưa vào sổ. Giữ lock khi huỷ theo DB vì placeOrder kiểm tra
+		// lại trạng thái dưới lock trước khi khớp, nên lệnh không thể vừa được hoàn tiền vừa được khớp.
+		// Chỉ huỷ theo DB khi market không còn batch nào chờ settle.
+		err := e.cancelUnbookedLocked(order)
+		e.mu.Unlock()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	log.Printf("CancelOrder: User %d cancelled order %d", userID, orderID)
+	cancelled, err := GetOrder(e.DB, userID, orderID)
+	if err != nil {
+		return nil, 0, err
+	}
+	e.publishOrderEvent(OrderEvent{Event: OrderCancelled, Order: *cancelled})
+	e.publishBalances([]balanceKey{{userID, lockedAsset(order.Symbol, order.Side)}})
+	return cancelled, remaining, nil
+}
+
+// cancelUnbookedLocked: Huỷ theo DB lệnh không có trên sổ RAM, gọi khi đang giữ e.mu
+func (e *Engine) cancelUnbookedLocked(order *OrderInfo) error {
+	pending, err := e.hasUnsettledTrades(order.Symbol, order.ID)
+	if err != nil {
+		return err
+	}
+	if pending {
+		return ErrSettlementInProgress
+	}
+	return cancelOrder(e.DB, order.ID, order.UserID, -1)
+}
+
+// AmendResult: Lệnh cũ đã huỷ và lệnh thay thế (nil nếu lệnh cũ đã khớp đủ amount mới trong lúc sửa)
+type AmendResult struct {
+	Cancelled OrderInfo         `json:"cancelled"`
+	Order     *PlaceOrderResult `json:"order"`
+}
+
+// AmendOrder: Sửa giá/số lượng bằng cách huỷ rồi đặt lại (lệnh mới mất ưu tiên thời gian).
+// amount là tổng số lượng mới của lệnh; lệnh thay thế chỉ đặt phần chưa khớp (amount - đã khớp),
+// cùng symbol/side, clientOrderID là ID cho lệnh thay thế (tuỳ chọn).
+func (e *Engine) AmendOrder(userID, orderID int, price, amount float64, clientOrderID string) (*AmendResult, error) {
+	order, err := GetOrder(e.DB, userID, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !(price > 0) || math.IsInf(price, 1) || !(amount > order.Filled) || math.IsInf(amount, 1) {
+		return nil, ErrInvalidAmend
+	}
+	if err := ValidateClientOrderID(clientOrderID); err != nil {
+		return nil, err
+	}
+
+	cancelled, remaining, err := e.cancel(order)
+	if err != nil {
+		return nil, err
+	}
+	res := &AmendResult{Cancelled: *cancelled}
+	qty := quantizeAmount(amount - (order.Amount - remaining))
+	if qty <= 0 {
+		return res, nil
+	}
+
+	res.Order, err = e.PlaceOrder(userID, order.Symbol, order.Side, price, qty, clientOrderID)
+	if err != nil {
+		return res, fmt.Errorf("order %d cancelled but replacement failed: %w", orderID, err)
+	}
+	log.Printf("AmendOrder: User %d replaced order %d with %d", userID, orderID, res.Order.ID)
+	return res, nil
+}
+
+// MassCancelResult: Các lệnh đã huỷ và các lệnh không huỷ được kèm lý do
+type MassCancelResult struct {
+	Cancelled []OrderInfo         `json:"cancelled"`
+	Failed    []MassCancelFailure `json:"failed"`
+}
+
+type MassCancelFailure struct {
+	OrderID int    `json:"order_id"`
+	Error   string `json:"error"`
+}
+
+// CancelAllOrders: Huỷ mọi lệnh đang mở của user (symbol rỗng = mọi market).
+// Lệnh vừa khớp hết trong lúc huỷ được bỏ qua.
+func (e *Engine) CancelAllOrders(userID int, symbol string) (*MassCancelResult, error) {
+	ctx := context.Background()
+	rows, err := e.DB.Query(ctx,
+		`SELECT `+orderColumns+` FROM orders
+		 WHERE user_id=$1 AND status IN ('OPEN', 'PARTIAL') AND ($2 = '' OR symbol = $2)
+		 ORDER BY id`,
+		userID, symbol)
+	if err != nil {
+		return nil, err
+	}
+	var open []*OrderInfo
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		open = append(open, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	res := &MassCancelResult{Cancelled: make([]OrderInfo, 0, len(open)), Failed: make([]MassCancelFailure, 0)}
+	for _, o := range open {
+		cancelled, _, err := e.cancel(o)
+		switch {
+		case err == nil:
+			res.Cancelled = append(res.Cancelled, *cancelled)
+		case errors.Is(err, ErrOrderNotCancellable):
+		default:
+			res.Failed = append(res.Failed, MassCancelFailure{OrderID: o.ID, Error: err.Error()})
+		}
+	}
+	return res, nil
+}
+
+func (e *Engine) CancelOrderByClientID(userID int, clientOrderID string) (*OrderInfo, error) {
+	order, err := GetOrderByClientID(e.DB, userID, clientOrderID)
+	if err != nil {
+		return nil, err
+	}
+	return e.CancelOrder(userID, order.ID)
+}
+
+// hasUnsettledTrades: Lệnh có nằm trong batch chưa settle (kể cả batch DEAD chờ replay) không.
+// Batch lỗi của lệnh khác trong cùng market không chặn việc huỷ lệnh này.
+func (e *Engine) hasUnsettledTrades(symbol string, orderID int) (bool, error) {
+	ctx := context.Background()
+	var exists bool
+	err := e.DB.QueryRow(ctx,
+		`SELECT EXISTS (
+		     SELECT 1 FROM settlement_batches b, jsonb_array_elements(b.trades) t
+		     WHERE b.symbol=$1 AND b.status IN ('PENDING', 'DEAD')
+		       AND $2 IN ((t->>'MakerOrderID')::int, (t->>'TakerOrderID')::int)
+		 )`,
+		symbol, orderID).Scan(&exists)
+	return exists, err
+}
+
+// sameOrderParams: Gửi lại client_order_id chỉ được coi là retry khi tham số giống lệnh gốc.
+// Giá/số lượng so sánh theo độ chính xác lưu trong DB (8 chữ số thập phân).
+func sameOrderParams(o *OrderInfo, symbol, side string, price, amount float64) bool {
+	const eps = 5e-9
+	return o.Symbol == symbol && o.Side == side &&
+		math.Abs(o.Price-price) < eps && math.Abs(o.Amount-amount) < eps
+}
+
+// cancelOrder: remaining < 0 nghĩa là lấy phần chưa khớp theo DB (amount - filled)
+func cancelOrder(db *pgxpool.Pool, orderID, userID int, remaining float64) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var status, side, symbol string
+	var price, amount, filled float64
+	err = tx.QueryRow(ctx,
+		`SELECT status, side, symbol, price, amount, filled
+		 FROM orders
+		 WHERE id=$1 AND user_id=$2
+		 FOR UPDATE`,
+		orderID, userID).
+		Scan(&status, &side, &symbol, &price, &amount, &filled)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		return err
+	}
+	if status != "OPEN" && status != "PARTIAL" {
+		return ErrOrderNotCancellable
+	}
+	if remaining < 0 {
+		remaining = amount - filled
+	}
+
+	base, quote := splitSymbol(symbol)
+	asset, refund := base, remaining
+	if side == "BUY" {
+		asset, refund = quote, remaining*price
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE balances
+		 SET available = available + $1,
+		     locked = locked - $1
+		 WHERE user_id=$2 AND asset_symbol=$3`,
+		refund, userID, asset)
+	if err != nil {
+		return fmt.Errorf("refund %s: %w", asset, err)
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE orders SET status='CANCELLED' WHERE id=$1`, orderID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
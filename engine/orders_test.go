@@ -0,0 +1,29 @@
+package engine
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// Lệnh sai side/giá/số lượng phải bị từ chối trước khi chạm tới DB (Engine không có DB vẫn chạy được)
+func TestPlaceOrderRejectsInvalidParams(t *testing.T) {
+	e := &Engine{}
+	for _, tc := range []struct {
+		name          string
+		side          string
+		price, amount float64
+	}{
+		{"lowercase side", "sell", 100, 1},
+		{"unknown side", "SHORT", 100, 1},
+		{"zero price", "BUY", 0, 1},
+		{"negative amount", "SELL", 100, -1},
+		{"infinite price", "BUY", math.Inf(1), 1},
+		{"NaN amount", "SELL", 100, math.NaN()},
+	} {
+		_, err := e.PlaceOrder(1, "BTC_USDT", tc.side, tc.price, tc.amount, "")
+		if !errors.Is(err, ErrInvalidOrder) {
+			t.Errorf("%s: got %v, want ErrInvalidOrder", tc.name, err)
+		}
+	}
+}
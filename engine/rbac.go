@@ -0,0 +1,366 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Vai trò của user. Mọi tài khoản mới đều là trader.
+const (
+	RoleTrader  = "trader"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+	RoleAuditor = "auditor"
+)
+
+// Quyền trên các API /admin
+const (
+	AdminPermWithdrawalsRead     = "withdrawals:read"
+	AdminPermWithdrawalsReview   = "withdrawals:review"
+	AdminPermWithdrawalsComplete = "withdrawals:complete"
+	AdminPermSettlementsRead     = "settlements:read"
+	AdminPermSettlementsReplay   = "settlements:replay"
+	AdminPermMarketsHalt         = "markets:halt"
+	AdminPermUsersManage         = "users:manage"
+	AdminPermAuditRead           = "audit:read"
+	AdminPermBalancesRead        = "balances:read"
+	AdminPermBalancesAdjust      = "balances:adjust"  // Tạo yêu cầu điều chỉnh
+	AdminPermBalancesApprove     = "balances:approve" // Duyệt yêu cầu của người khác
+)
+
+// rolePermissions: admin có mọi quyền, support xử lý vận hành hằng ngày, auditor chỉ xem
+var rolePermissions = map[string][]string{
+	RoleTrader: {},
+	RoleSupport: {
+		AdminPermWithdrawalsRead,
+		AdminPermWithdrawalsReview,
+		AdminPermSettlementsRead,
+		AdminPermBalancesRead,
+		AdminPermBalancesAdjust,
+	},
+	RoleAuditor: {
+		AdminPermWithdrawalsRead,
+		AdminPermSettlementsRead,
+		AdminPermAuditRead,
+		AdminPermBalancesRead,
+	},
+	RoleAdmin: {
+		AdminPermWithdrawalsRead,
+		AdminPermWithdrawalsReview,
+		AdminPermWithdrawalsComplete,
+		AdminPermSettlementsRead,
+		AdminPermSettlementsReplay,
+		AdminPermMarketsHalt,
+		AdminPermUsersManage,
+		AdminPermAuditRead,
+		AdminPermBalancesRead,
+		AdminPermBalancesAdjust,
+		AdminPermBalancesApprove,
+	},
+}
+
+var (
+	ErrInvalidRole         = errors.New("invalid role")
+	ErrDualControlRequired = errors.New("granting this role requires approval by a second admin")
+	ErrRoleGrantNotFound   = errors.New("role grant not found")
+	ErrRoleGrantDecided    = errors.New("role grant has already been approved or rejected")
+	ErrRoleGrantSelfReview = errors.New("a role grant must be approved by an admin other than the requester and the grantee")
+	ErrBootstrapClosed     = errors.New("admin bootstrap is only allowed while fewer than two admins exist")
+)
+
+// MinAdmins: Cần ít nhất hai admin để dual control hoạt động (một người yêu cầu, người khác duyệt)
+const MinAdmins = 2
+
+// dualControlRoles: Các role phải qua RequestRoleGrant + ApproveRoleGrant, không cấp thẳng được.
+// Nếu không, một admin có thể tự cấp admin cho tài khoản thứ hai rồi tự duyệt điều chỉnh số dư của mình.
+var dualControlRoles = []string{RoleAdmin}
+
+func RequiresDualControl(role string) bool {
+	return slices.Contains(dualControlRoles, role)
+}
+
+// Trạng thái yêu cầu cấp role
+const (
+	RoleGrantPending  = "PENDING"
+	RoleGrantApproved = "APPROVED"
+	RoleGrantRejected = "REJECTED"
+)
+
+type RoleGrant struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	Role        string     `json:"role"`
+	RequestedBy int        `json:"requested_by"`
+	Status      string     `json:"status"`
+	DecidedBy   *int       `json:"decided_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DecidedAt   *time.Time `json:"decided_at,omitempty"`
+}
+
+// RoleHasPermission: Role không tồn tại thì không có quyền gì
+func RoleHasPermission(role, perm string) bool {
+	return slices.Contains(rolePermissions[role], perm)
+}
+
+// IsStaffRole: Mọi role trừ trader đều được vào /admin (quyền cụ thể kiểm tra riêng)
+func IsStaffRole(role string) bool {
+	return role != RoleTrader && len(rolePermissions[role]) > 0
+}
+
+func GetUserRole(db *pgxpool.Pool, userID int) (string, error) {
+	ctx := context.Background()
+	var role string
+	err := db.QueryRow(ctx, `SELECT role FROM users WHERE id=$1`, userID).Scan(&role)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrUserNotFound
+		}
+		return "", err
+	}
+	return role, nil
+}
+
+// SetUserRole: Sub-account luôn là trader, không được cấp quyền quản trị.
+// Role trong dualControlRoles phải đi qua RequestRoleGrant.
+func SetUserRole(db *pgxpool.Pool, adminID, userID int, role string) error {
+	if _, ok := rolePermissions[role]; !ok {
+		return ErrInvalidRole
+	}
+	if RequiresDualControl(role) {
+		return ErrDualControlRequired
+	}
+
+	ctx := context.Background()
+	tag, err := db.Exec(ctx,
+		`UPDATE users SET role=$1, role_granted_by=$3, role_approved_by=NULL
+		 WHERE id=$2 AND (parent_id IS NULL OR $1 = 'trader')`,
+		role, userID, adminID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	log.Printf("SetUserRole: Admin %d set user %d role to %s", adminID, userID, role)
+	return nil
+}
+
+// BootstrapAdmin: Cấp admin cho tài khoản email khi hệ thống còn ít hơn MinAdmins admin, để có người duyệt
+// cho việc cấp admin và điều chỉnh số dư. Chỉ gọi lúc khởi động (BOOTSTRAP_ADMIN_EMAIL); đủ admin rồi thì
+// mọi việc cấp admin phải qua RequestRoleGrant. Tài khoản đã là admin thì không làm gì.
+func BootstrapAdmin(db *pgxpool.Pool, email string) error {
+	ctx := context.Background()
+	email = normalizeEmail(email)
+	var userID int
+	err := db.QueryRow(ctx,
+		`UPDATE users SET role='admin', role_granted_by=NULL, role_approved_by=NULL
+		 WHERE email=$1 AND parent_id IS NULL AND role <> 'admin'
+		   AND (SELECT COUNT(*) FROM users WHERE role='admin') < $2
+		 RETURNING id`,
+		email, MinAdmins).Scan(&userID)
+	if err == nil {
+		log.Printf("BootstrapAdmin: User %d (%s) is now an admin", userID, email)
+		return nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	var role string
+	err = db.QueryRow(ctx,
+		`SELECT role FROM users WHERE email=$1 AND parent_id IS NULL`,
+		email).Scan(&role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if role == RoleAdmin {
+		return nil
+	}
+	return ErrBootstrapClosed
+}
+
+const roleGrantColumns = `id, user_id, role, requested_by, status, decided_by, created_at, decided_at`
+
+func scanRoleGrant(row pgx.Row) (*RoleGrant, error) {
+	var g RoleGrant
+	err := row.Scan(&g.ID, &g.UserID, &g.Role, &g.RequestedBy, &g.Status, &g.DecidedBy, &g.CreatedAt, &g.DecidedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// RequestRoleGrant: Tạo yêu cầu cấp role cần hai admin, role chưa đổi cho tới khi được duyệt
+func RequestRoleGrant(db *pgxpool.Pool, adminID, userID int, role string) (*RoleGrant, error) {
+	if !RequiresDualControl(role) {
+		return nil, ErrInvalidRole
+	}
+
+	ctx := context.Background()
+	g, err := scanRoleGrant(db.QueryRow(ctx,
+		`INSERT INTO role_grants (user_id, role, requested_by)
+		 SELECT id, $2, $3 FROM users WHERE id=$1 AND parent_id IS NULL
+		 RETURNING `+roleGrantColumns,
+		userID, role, adminID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	log.Printf("RequestRoleGrant: Admin %d requested #%d: user %d role %s", adminID, g.ID, userID, role)
+	return g, nil
+}
+
+func ListRoleGrants(db *pgxpool.Pool, status string) ([]RoleGrant, error) {
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT `+roleGrantColumns+` FROM role_grants
+		 WHERE $1 = '' OR status = $1
+		 ORDER BY id DESC
+		 LIMIT 500`,
+		status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := make([]RoleGrant, 0)
+	for rows.Next() {
+		g, err := scanRoleGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, *g)
+	}
+	return grants, rows.Err()
+}
+
+// DecideRoleGrant: Duyệt thì đổi role ngay trong cùng transaction, ghi lại cả người yêu cầu lẫn người duyệt
+func DecideRoleGrant(db *pgxpool.Pool, id, adminID int, approve bool) (*RoleGrant, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	g, err := scanRoleGrant(tx.QueryRow(ctx,
+		`SELECT `+roleGrantColumns+` FROM role_grants WHERE id=$1 FOR UPDATE`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrRoleGrantNotFound
+		}
+		return nil, err
+	}
+	if g.Status != RoleGrantPending {
+		return nil, ErrRoleGrantDecided
+	}
+	if approve && (adminID == g.RequestedBy || adminID == g.UserID) {
+		return nil, ErrRoleGrantSelfReview
+	}
+
+	status := RoleGrantRejected
+	if approve {
+		status = RoleGrantApproved
+		tag, err := tx.Exec(ctx,
+			`UPDATE users SET role=$1, role_granted_by=$2, role_approved_by=$3
+			 WHERE id=$4 AND parent_id IS NULL`,
+			g.Role, g.RequestedBy, adminID, g.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if tag.RowsAffected() == 0 {
+			return nil, ErrUserNotFound
+		}
+	}
+
+	g, err = scanRoleGrant(tx.QueryRow(ctx,
+		`UPDATE role_grants SET status=$1, decided_by=$2, decided_at=NOW()
+		 WHERE id=$3
+		 RETURNING `+roleGrantColumns,
+		status, adminID, id))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	log.Printf("DecideRoleGrant: Admin %d %s #%d (user %d role %s, requested by %d)", adminID, status, id, g.UserID, g.Role, g.RequestedBy)
+	return g, nil
+}
+
+// --- ADMIN AUDIT LOG ---
+
+type AdminAuditEntry struct {
+	ID         int64           `json:"id"`
+	AdminID    int             `json:"admin_id"`
+	Role       string          `json:"role"`
+	Action     string          `json:"action"` // Ví dụ: "POST /admin/markets/:symbol/halt"
+	Params     json.RawMessage `json:"params"` // Path params, query và body của request
+	StatusCode int             `json:"status_code"`
+	IP         string          `json:"ip"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// AuditLogFilter: Các trường rỗng/0 nghĩa là không lọc
+type AuditLogFilter struct {
+	AdminID  int
+	Action   string
+	BeforeID int64 // Phân trang: chỉ lấy các bản ghi có id < BeforeID
+	Limit    int
+}
+
+// RecordAdminAction: Chỉ INSERT, log không bao giờ bị sửa/xoá qua ứng dụng
+func RecordAdminAction(db *pgxpool.Pool, e AdminAuditEntry) error {
+	ctx := context.Background()
+	_, err := db.Exec(ctx,
+		`INSERT INTO admin_audit_log (admin_id, role, action, params, status_code, ip)
+		 VALUES ($1,$2,$3,$4,$5,$6)`,
+		e.AdminID, e.Role, e.Action, e.Params, e.StatusCode, e.IP)
+	return err
+}
+
+func ListAdminAuditLog(db *pgxpool.Pool, f AuditLogFilter) ([]AdminAuditEntry, error) {
+	if f.Limit <= 0 || f.Limit > 500 {
+		f.Limit = 100
+	}
+
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT id, admin_id, role, action, params, status_code, ip, created_at
+		 FROM admin_audit_log
+		 WHERE ($1 = 0 OR admin_id = $1)
+		   AND ($2 = '' OR action = $2)
+		   AND ($3::bigint = 0 OR id < $3)
+		 ORDER BY id DESC
+		 LIMIT $4`,
+		f.AdminID, f.Action, f.BeforeID, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]AdminAuditEntry, 0)
+	for rows.Next() {
+		var e AdminAuditEntry
+		if err := rows.Scan(&e.ID, &e.AdminID, &e.Role, &e.Action, &e.Params, &e.StatusCode, &e.IP, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,674 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Cấu hình hàng đợi settlement
+const (
+	MaxSettlementAttempts  = 8 // Quá số lần này -> chuyển sang dead-letter
+	SettlementBaseBackoff  = 500 * time.Millisecond
+	SettlementMaxBackoff   = time.Minute
+	MaxPendingSettlements  = 100              // Số batch tồn đọng tối đa trước khi dừng market
+	MaxSettlementLag       = 30 * time.Second // Batch cũ nhất chờ quá lâu -> dừng market
+	settlementPollInterval = time.Second
+	settlementClaimLimit   = 50
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter: Batch settlement thất bại vĩnh viễn, chờ admin kiểm tra và replay
+type DeadLetter struct {
+	ID         int64      `json:"id"`
+	BatchID    int64      `json:"batch_id"`
+	Symbol     string     `json:"symbol"`
+	Trades     []Trade    `json:"trades"`
+	Attempts   int        `json:"attempts"`
+	LastError  string     `json:"last_error"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReplayedAt *time.Time `json:"replayed_at,omitempty"`
+	ReplayedBy *int       `json:"replayed_by,omitempty"`
+}
+
+// SettlementStatus: Tình trạng hàng đợi settlement của một market
+type SettlementStatus struct {
+	Symbol       string     `json:"symbol"`
+	Pending      int        `json:"pending"`
+	OldestQueued *time.Time `json:"oldest_queued,omitempty"`
+	DeadLetters  int        `json:"dead_letters"`
+	HaltReason   string     `json:"halt_reason,omitempty"`
+}
+
+// enqueueSettlement: Cấp ID cho trades rồi lưu batch xuống DB trước khi settle
+func (e *Engine) enqueueSettlement(symbol string, trades []Trade) (int64, error) {
+	ctx := context.Background()
+	rows, err := e.DB.Query(ctx,
+		`SELECT nextval('trades_id_seq') FROM generate_series(1, $1)`, len(trades))
+	if err != nil {
+		return 0, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return 0, err
+	}
+	for i := range trades {
+		trades[i].ID = ids[i]
+	}
+
+	payload, err := json.Marshal(trades)
+	if err != nil {
+		return 0, err
+	}
+
+	var batchID int64
+	err = e.DB.QueryRow(ctx,
+		`INSERT INTO settlement_batches (symbol, trades) VALUES ($1, $2) RETURNING id`,
+		symbol, payload).Scan(&batchID)
+	return batchID, err
+}
+
+// settleBatch: Settle một batch đang PENDING. Batch đang được worker khác xử lý sẽ bị bỏ qua.
+// Đánh dấu SETTLED trong cùng transaction với việc chuyển tiền -> mỗi batch chỉ settle đúng 1 lần.
+func (e *Engine) settleBatch(batchID int64) error {
+	ctx := context.Background()
+	tx, err := e.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var symbol string
+	var payload []byte
+	err = tx.QueryRow(ctx,
+		`SELECT symbol, trades FROM settlement_batches
+		 WHERE id=$1 AND status='PENDING'
+		 FOR UPDATE SKIP LOCKED`,
+		batchID).Scan(&symbol, &payload)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil // Đã settle xong hoặc đang được xử lý ở nơi khác
+		}
+		return err
+	}
+
+	var trades []Trade
+	err = json.Unmarshal(payload, &trades)
+	if err == nil {
+		err = SettleTrades(ctx, tx, trades)
+	}
+	if err != nil {
+		// Nhả lock của batch trước khi ghi nhận lỗi bằng transaction khác
+		tx.Rollback(ctx)
+		return e.recordSettlementFailure(batchID, symbol, err)
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE settlement_batches SET status='SETTLED', settled_at=NOW() WHERE id=$1`,
+		batchID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return e.recordSettlementFailure(batchID, symbol, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return e.recordSettlementFailure(batchID, symbol, err)
+	}
+	e.publishSettled(trades)
+	return nil
+}
+
+func settlementBackoff(attempts int) time.Duration {
+	d := time.Duration(float64(SettlementBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if d > SettlementMaxBackoff {
+		d = SettlementMaxBackoff
+	}
+	return d
+}
+
+// recordSettlementFailure: Tăng số lần thử và hẹn giờ thử lại.
+// Hết số lần thử -> chuyển vào settlement_dead_letters và dừng market.
+func (e *Engine) recordSettlementFailure(batchID int64, symbol string, cause error) error {
+	ctx := context.Background()
+	tx, err := e.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("CRITICAL: Cannot record failure of settlement batch #%d: %v (cause: %v)", batchID, err, cause)
+		return cause
+	}
+	defer tx.Rollback(ctx)
+
+	var attempts int
+	err = tx.QueryRow(ctx,
+		`UPDATE settlement_batches SET attempts = attempts + 1, last_error = $2
+		 WHERE id=$1 AND status='PENDING'
+		 RETURNING attempts`,
+		batchID, cause.Error()).Scan(&attempts)
+	if err != nil {
+		log.Printf("CRITICAL: Cannot record failure of settlement batch #%d: %v (cause: %v)", batchID, err, cause)
+		return cause
+	}
+
+	dead := attempts >= MaxSettlementAttempts
+	if dead {
+		_, err = tx.Exec(ctx,
+			`UPDATE settlement_batches SET status='DEAD' WHERE id=$1`,
+			batchID)
+		if err == nil {
+			_, err = tx.Exec(ctx,
+				`INSERT INTO settlement_dead_letters (batch_id, symbol, trades, attempts, last_error)
+				 SELECT id, symbol, trades, attempts, last_error FROM settlement_batches WHERE id=$1`,
+				batchID)
+		}
+	} else {
+		_, err = tx.Exec(ctx,
+			`UPDATE settlement_batches SET next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond'
+			 WHERE id=$1`,
+			batchID, settlementBackoff(attempts).Milliseconds())
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		log.Printf("CRITICAL: Cannot record failure of settlement batch #%d: %v (cause: %v)", batchID, err, cause)
+		return cause
+	}
+
+	if dead {
+		log.Printf("CRITICAL: Settlement batch #%d moved to dead-letter after %d attempts: %v", batchID, attempts, cause)
+		e.HaltMarket(symbol, fmt.Sprintf("settlement batch #%d failed permanently", batchID))
+	}
+	return cause
+}
+
+// RunSettlementWorker: Vòng lặp nền thử lại các batch lỗi và theo dõi độ trễ settlement
+func (e *Engine) RunSettlementWorker() {
+	ticker := time.NewTicker(settlementPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := e.retryDueSettlements(); err != nil {
+			log.Printf("Settlement worker: %v", err)
+		}
+		if err := e.checkSettlementLag(); err != nil {
+			log.Printf("Settlement worker: %v", err)
+		}
+	}
+}
+
+// retryDueSettlements: Gom các batch đến hạn và settle chung trong một transaction.
+// Nếu cả nhóm lỗi thì settle lại từng batch để cô lập batch hỏng và ghi nhận lỗi riêng.
+func (e *Engine) retryDueSettlements() error {
+	ctx := context.Background()
+	tx, err := e.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`SELECT id, trades FROM settlement_batches
+		 WHERE status='PENDING' AND next_attempt_at <= NOW()
+		 ORDER BY id
+		 LIMIT $1
+		 FOR UPDATE SKIP LOCKED`,
+		settlementClaimLimit)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	var trades []Trade
+	var decodeErr error
+	for rows.Next() {
+		var id int64
+		var payload []byte
+		if err := rows.Scan(&id, &payload); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+
+		var batch []Trade
+		if err := json.Unmarshal(payload, &batch); err != nil {
+			decodeErr = err
+		}
+		trades = append(trades, batch...)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	err = decodeErr
+	if err == nil {
+		err = SettleTrades(ctx, tx, trades)
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx,
+			`UPDATE settlement_batches SET status='SETTLED', settled_at=NOW() WHERE id = ANY($1)`,
+			ids)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err == nil {
+		log.Printf("Settled %d queued batches (%d trades)", len(ids), len(trades))
+		e.publishSettled(trades)
+		return nil
+	}
+
+	log.Printf("Settling %d queued batches together failed, retrying one by one: %v", len(ids), err)
+	tx.Rollback(ctx)
+	for _, id := range ids {
+		if err := e.settleBatch(id); err != nil {
+			log.Printf("Settlement batch #%d retry failed: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// checkSettlementLag: Dừng market nếu settlement tồn đọng quá nhiều hoặc quá lâu
+func (e *Engine) checkSettlementLag() error {
+	ctx := context.Background()
+	rows, err := e.DB.Query(ctx,
+		`SELECT symbol, COUNT(*), EXTRACT(EPOCH FROM NOW() - MIN(created_at))
+		 FROM settlement_batches
+		 WHERE status='PENDING'
+		 GROUP BY symbol`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var symbol string
+		var pending int
+		var lagSeconds float64
+		if err := rows.Scan(&symbol, &pending, &lagSeconds); err != nil {
+			return err
+		}
+
+		lag := time.Duration(lagSeconds * float64(time.Second))
+		if pending > MaxPendingSettlements || lag > MaxSettlementLag {
+			e.HaltMarket(symbol, fmt.Sprintf("settlement lagging: %d batches pending, oldest %s", pending, lag.Round(time.Second)))
+		}
+	}
+	return rows.Err()
+}
+
+// HaltMarket: Tạm dừng nhận lệnh mới cho symbol
+func (e *Engine) HaltMarket(symbol, reason string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.haltLocked(symbol, reason)
+}
+
+func (e *Engine) haltLocked(symbol, reason string) {
+	if _, ok := e.halted[symbol]; ok {
+		return
+	}
+	e.halted[symbol] = reason
+	log.Printf("MARKET HALTED %s: %s", symbol, reason)
+}
+
+// ResumeMarket: Mở lại market (admin gọi sau khi đã xử lý nguyên nhân)
+func (e *Engine) ResumeMarket(symbol string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.OrderBooks[symbol]; !ok {
+		return ErrSymbolNotFound
+	}
+	delete(e.halted, symbol)
+	log.Printf("MARKET RESUMED %s", symbol)
+	return nil
+}
+
+// HaltReason trả về lý do dừng, rỗng nếu market đang hoạt động
+func (e *Engine) HaltReason(symbol string) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.halted[symbol]
+}
+
+func (e *Engine) SettlementStatus() ([]SettlementStatus, error) {
+	ctx := context.Background()
+	e.mu.Lock()
+	result := make([]SettlementStatus, 0, len(e.OrderBooks))
+	index := make(map[string]int)
+	for symbol := range e.OrderBooks {
+		index[symbol] = len(result)
+		result = append(result, SettlementStatus{Symbol: symbol, HaltReason: e.halted[symbol]})
+	}
+	e.mu.Unlock()
+
+	rows, err := e.DB.Query(ctx,
+		`SELECT symbol,
+		        COUNT(*) FILTER (WHERE status='PENDING'),
+		        MIN(created_at) FILTER (WHERE status='PENDING'),
+		        COUNT(*) FILTER (WHERE status='DEAD')
+		 FROM settlement_batches
+		 WHERE status IN ('PENDING', 'DEAD')
+		 GROUP BY symbol`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var st SettlementStatus
+		if err := rows.Scan(&st.Symbol, &st.Pending, &st.OldestQueued, &st.DeadLetters); err != nil {
+			return nil, err
+		}
+		if i, ok := index[st.Symbol]; ok {
+			st.HaltReason = result[i].HaltReason
+			result[i] = st
+		} else {
+			result = append(result, st)
+		}
+	}
+	return result, rows.Err()
+}
+
+const deadLetterColumns = `id, batch_id, symbol, trades, attempts, COALESCE(last_error, ''), created_at, replayed_at, replayed_by`
+
+func scanDeadLetter(row pgx.Row) (*DeadLetter, error) {
+	var d DeadLetter
+	var payload []byte
+	err := row.Scan(&d.ID, &d.BatchID, &d.Symbol, &payload, &d.Attempts, &d.LastError, &d.CreatedAt, &d.ReplayedAt, &d.ReplayedBy)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(payload, &d.Trades); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ListDeadLetters: includeReplayed=false chỉ lấy các batch chưa được xử lý
+func (e *Engine) ListDeadLetters(includeReplayed bool) ([]DeadLetter, error) {
+	ctx := context.Background()
+	rows, err := e.DB.Query(ctx,
+		`SELECT `+deadLetterColumns+` FROM settlement_dead_letters
+		 WHERE $1 OR replayed_at IS NULL
+		 ORDER BY id`,
+		includeReplayed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := make([]DeadLetter, 0)
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, *d)
+	}
+	return letters, rows.Err()
+}
+
+func (e *Engine) GetDeadLetter(id int64) (*DeadLetter, error) {
+	ctx := context.Background()
+	d, err := scanDeadLetter(e.DB.QueryRow(ctx,
+		`SELECT `+deadLetterColumns+` FROM settlement_dead_letters WHERE id=$1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrDeadLetterNotFound
+	}
+	return d, err
+}
+
+// ReplayDeadLetter: Đưa batch về lại hàng đợi (PENDING, reset số lần thử) rồi settle ngay
+func (e *Engine) ReplayDeadLetter(id int64, adminID int) error {
+	ctx := context.Background()
+	tx, err := e.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var batchID int64
+	err = tx.QueryRow(ctx,
+		`UPDATE settlement_dead_letters SET replayed_at=NOW(), replayed_by=$2
+		 WHERE id=$1 AND replayed_at IS NULL
+		 RETURNING batch_id`,
+		id, adminID).Scan(&batchID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrDeadLetterNotFound
+		}
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE settlement_batches
+		 SET status='PENDING', attempts=0, next_attempt_at=NOW()
+		 WHERE id=$1 AND status='DEAD'`,
+		batchID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	log.Printf("ReplayDeadLetter: Dead letter #%d (batch #%d) replayed by %d", id, batchID, adminID)
+	return e.settleBatch(batchID)
+}
+
+type balanceKey struct {
+	userID int
+	asset  string
+}
+
+type balanceDelta struct {
+	available float64
+	locked    float64
+}
+
+// splitSymbol: "BTC_USDT" -> ("BTC", "USDT")
+func splitSymbol(symbol string) (base, quote string) {
+	base, quote, _ = strings.Cut(symbol, "_")
+	return base, quote
+}
+
+// settlementDeltas: Thay đổi số dư gộp theo (user, asset) và số lượng khớp gộp theo order của các trades
+func settlementDeltas(trades []Trade) (map[balanceKey]*balanceDelta, map[int]float64) {
+	fills := make(map[int]float64)
+	deltas := make(map[balanceKey]*balanceDelta)
+	add := func(userID int, asset string, available, locked float64) {
+		k := balanceKey{userID, asset}
+		d, ok := deltas[k]
+		if !ok {
+			d = &balanceDelta{}
+			deltas[k] = d
+		}
+		d.available += available
+		d.locked += locked
+	}
+
+	for _, t := range trades {
+		base, quote := splitSymbol(t.Symbol)
+		cost := t.Price * t.Amount
+
+		// Tiền đã bị lock lúc đặt lệnh: người mua lock quote, người bán lock base
+		buyerID, sellerID := t.TakerUserID, t.MakerUserID
+		if t.TakerSide == "SELL" {
+			buyerID, sellerID = t.MakerUserID, t.TakerUserID
+		}
+		// Phí trừ thẳng vào phần nhận về và cộng cho tài khoản thu phí
+		buyerFee, sellerFee := t.buyerSellerFees()
+		add(buyerID, quote, 0, -cost)
+		add(buyerID, base, t.Amount-buyerFee, 0)
+		add(sellerID, base, 0, -t.Amount)
+		add(sellerID, quote, cost-sellerFee, 0)
+		if buyerFee > 0 {
+			add(FeeAccountUserID, base, buyerFee, 0)
+		}
+		if sellerFee > 0 {
+			add(FeeAccountUserID, quote, sellerFee, 0)
+		}
+
+		// Taker mua khớp được giá thấp hơn giá limit -> trả lại phần quote khoá dư
+		if t.TakerSide == "BUY" && t.TakerPrice > t.Price {
+			refund := (t.TakerPrice - t.Price) * t.Amount
+			add(t.TakerUserID, quote, refund, -refund)
+		}
+
+		fills[t.MakerOrderID] += t.Amount
+		fills[t.TakerOrderID] += t.Amount
+	}
+	return deltas, fills
+}
+
+// SettleTrades: Chuyển tiền, cập nhật orders, lưu trades và cộng vào nến cho cả một batch trong transaction tx.
+// Số dư được gộp theo (user, asset) rồi áp dụng bằng các câu lệnh set-based (unnest),
+// tất cả được gửi trong một pgx.Batch -> chỉ một round trip dù batch có bao nhiêu trades.
+func SettleTrades(ctx context.Context, tx pgx.Tx, trades []Trade) error {
+	if len(trades) == 0 {
+		return nil
+	}
+
+	n := len(trades)
+	tradeIDs := make([]int64, 0, n)
+	symbols := make([]string, 0, n)
+	makerOrderIDs := make([]int, 0, n)
+	takerOrderIDs := make([]int, 0, n)
+	takerSides := make([]string, 0, n)
+	prices := make([]float64, 0, n)
+	amounts := make([]float64, 0, n)
+	makerFees := make([]float64, 0, n)
+	takerFees := make([]float64, 0, n)
+	makerFeeAssets := make([]string, 0, n)
+	takerFeeAssets := make([]string, 0, n)
+	createdAt := make([]time.Time, 0, n)
+
+	deltas, fills := settlementDeltas(trades)
+	for _, t := range trades {
+		tradeIDs = append(tradeIDs, t.ID)
+		symbols = append(symbols, t.Symbol)
+		makerOrderIDs = append(makerOrderIDs, t.MakerOrderID)
+		takerOrderIDs = append(takerOrderIDs, t.TakerOrderID)
+		takerSides = append(takerSides, t.TakerSide)
+		prices = append(prices, t.Price)
+		amounts = append(amounts, t.Amount)
+		makerSide := "BUY"
+		if t.TakerSide == "BUY" {
+			makerSide = "SELL"
+		}
+		makerFees = append(makerFees, t.MakerFee)
+		takerFees = append(takerFees, t.TakerFee)
+		makerFeeAssets = append(makerFeeAssets, feeAsset(t.Symbol, makerSide))
+		takerFeeAssets = append(takerFeeAssets, feeAsset(t.Symbol, t.TakerSide))
+		createdAt = append(createdAt, t.CreatedAt)
+	}
+
+	// Sắp xếp theo (user, asset) để mọi transaction khoá balances cùng một thứ tự (tránh deadlock)
+	keys := make([]balanceKey, 0, len(deltas))
+	for k := range deltas {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].userID == keys[j].userID {
+			return keys[i].asset < keys[j].asset
+		}
+		return keys[i].userID < keys[j].userID
+	})
+	userIDs := make([]int, len(keys))
+	assets := make([]string, len(keys))
+	availableDeltas := make([]float64, len(keys))
+	lockedDeltas := make([]float64, len(keys))
+	for i, k := range keys {
+		userIDs[i], assets[i] = k.userID, k.asset
+		availableDeltas[i], lockedDeltas[i] = deltas[k].available, deltas[k].locked
+	}
+
+	// Sắp xếp theo id để mọi transaction khoá orders cùng một thứ tự (tránh deadlock)
+	orderIDs := make([]int, 0, len(fills))
+	for id := range fills {
+		orderIDs = append(orderIDs, id)
+	}
+	sort.Ints(orderIDs)
+	orderFills := make([]float64, len(orderIDs))
+	for i, id := range orderIDs {
+		orderFills[i] = fills[id]
+	}
+
+	batch := &pgx.Batch{}
+
+	// A. Người nhận có thể chưa có dòng balance cho asset nhận về
+	batch.Queue(
+		`INSERT INTO balances (user_id, asset_symbol)
+		 SELECT * FROM unnest($1::int[], $2::varchar[])
+		 ON CONFLICT (user_id, asset_symbol) DO NOTHING`,
+		userIDs, assets)
+
+	// B. Khoá các dòng balance theo thứ tự
+	batch.Queue(
+		`SELECT 1 FROM balances b
+		 JOIN unnest($1::int[], $2::varchar[]) AS d(user_id, asset)
+		   ON b.user_id = d.user_id AND b.asset_symbol = d.asset
+		 ORDER BY b.user_id, b.asset_symbol
+		 FOR UPDATE OF b`,
+		userIDs, assets)
+
+	// C. Áp dụng thay đổi số dư đã gộp.
+	// Không chặn locked âm: CHECK (locked >= 0) làm batch lỗi -> retry/dead-letter thay vì che lỗi kế toán.
+	batch.Queue(
+		`UPDATE balances b
+		 SET available = b.available + d.available,
+		     locked = b.locked + d.locked
+		 FROM unnest($1::int[], $2::varchar[], $3::numeric[], $4::numeric[]) AS d(user_id, asset, available, locked)
+		 WHERE b.user_id = d.user_id AND b.asset_symbol = d.asset`,
+		userIDs, assets, availableDeltas, lockedDeltas)
+
+	// D. Khoá các dòng orders theo thứ tự id rồi cập nhật filled/status (gộp theo order)
+	batch.Queue(
+		`SELECT 1 FROM orders WHERE id = ANY($1::int[]) ORDER BY id FOR UPDATE`,
+		orderIDs)
+	batch.Queue(
+		`UPDATE orders o
+		 SET filled = o.filled + d.qty,
+		     status = CASE WHEN o.status = 'CANCELLED' THEN 'CANCELLED'
+		                   WHEN o.filled + d.qty >= o.amount THEN 'FILLED' ELSE 'PARTIAL' END
+		 FROM unnest($1::int[], $2::numeric[]) AS d(id, qty)
+		 WHERE o.id = d.id`,
+		orderIDs, orderFills)
+
+	// E. Lưu Trade History (batch cũ chưa có ID thì lấy ID mới từ sequence) và gộp các trade vừa lưu
+	// vào nến của mọi khung trong cùng câu lệnh -> bảng candles luôn khớp với trades
+	batch.Queue(
+		`WITH inserted AS (
+		     INSERT INTO trades (id, symbol, maker_order_id, taker_order_id, taker_side, price, amount,
+		                         maker_fee, maker_fee_asset, taker_fee, taker_fee_asset, created_at)
+		     SELECT COALESCE(NULLIF(t.id, 0), nextval('trades_id_seq')), t.symbol, t.maker_order_id, t.taker_order_id, t.taker_side,
+		            t.price, t.amount, t.maker_fee, t.maker_fee_asset, t.taker_fee, t.taker_fee_asset, t.created_at
+		     FROM unnest($1::bigint[], $2::varchar[], $3::int[], $4::int[], $5::varchar[], $6::numeric[], $7::numeric[],
+		                 $8::numeric[], $9::varchar[], $10::numeric[], $11::varchar[], $12::timestamptz[])
+		          AS t(id, symbol, maker_order_id, taker_order_id, taker_side, price, amount,
+		               maker_fee, maker_fee_asset, taker_fee, taker_fee_asset, created_at)
+		     RETURNING id, symbol, price, amount, created_at
+		 )`+candleUpsertSQL("inserted", "TRUE"),
+		tradeIDs, symbols, makerOrderIDs, takerOrderIDs, takerSides, prices, amounts,
+		makerFees, makerFeeAssets, takerFees, takerFeeAssets, createdAt)
+
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < batch.Len(); i++ {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return err
+		}
+	}
+	return br.Close()
+}
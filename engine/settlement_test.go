@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// dbRound: Làm tròn như khi ghi vào cột DECIMAL(20,8)
+func dbRound(x float64) float64 {
+	return math.Round(x*1e8) / 1e8
+}
+
+// lockedFor: Số tiền bị khoá cho remaining của lệnh o (như CreateBuyOrder/CreateSellOrder và cancelOrder)
+func lockedFor(o *Order, remaining float64) (string, float64) {
+	if o.Side == "BUY" {
+		return "USDT", remaining * o.Price
+	}
+	return "BTC", remaining
+}
+
+// Đầu vào ngẫu nhiên (như simulation) khớp thành rất nhiều lần khớp từng phần, mỗi trade settle trong một batch
+// riêng: locked không bao giờ âm (CHECK locked >= 0) và về đúng 0 khi mọi lệnh đã khớp hết hoặc bị huỷ,
+// phí không làm mất hay sinh thêm tiền.
+func TestPartialFillsSettleLockedToZero(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 50; round++ {
+		ob := NewOrderBook("BTC_USDT")
+		locked := make(map[balanceKey]float64)
+		var trades int
+
+		for i := 1; i <= 200; i++ {
+			side := "BUY"
+			if rng.Intn(2) == 0 {
+				side = "SELL"
+			}
+			o := &Order{
+				ID:        i,
+				UserID:    1 + rng.Intn(5),
+				Side:      side,
+				Price:     quantizePrice(50000 + rng.Float64()*20 - 10),
+				Amount:    quantizeAmount(rng.Float64() * 0.5),
+				Timestamp: int64(i),
+			}
+			if validateOrderParams(o.Side, o.Price, o.Amount) != nil {
+				continue
+			}
+			asset, amt := lockedFor(o, o.Amount)
+			k := balanceKey{o.UserID, asset}
+			locked[k] = dbRound(locked[k] + dbRound(amt))
+
+			matched, _ := ob.Process(o)
+			applyFees(matched)
+			for _, tr := range matched {
+				trades++
+				deltas, _ := settlementDeltas([]Trade{tr})
+				// Phí chuyển sang tài khoản thu phí: tổng mỗi asset trên toàn hệ thống không đổi
+				total := make(map[string]float64)
+				for k, d := range deltas {
+					total[k.asset] += dbRound(d.available) + dbRound(d.locked)
+				}
+				for asset, v := range total {
+					if dbRound(v) != 0 {
+						t.Fatalf("round %d: trade %+v changes total %s by %v", round, tr, asset, v)
+					}
+				}
+				for k, d := range deltas {
+					locked[k] = dbRound(locked[k] + dbRound(d.locked))
+					if locked[k] < 0 {
+						t.Fatalf("round %d: locked %s of user %d went negative: %v", round, k.asset, k.userID, locked[k])
+					}
+				}
+			}
+		}
+
+		for _, o := range append(append([]*Order{}, ob.Bids...), ob.Asks...) {
+			asset, refund := lockedFor(o, quantizeAmount(o.Amount-o.Filled))
+			k := balanceKey{o.UserID, asset}
+			locked[k] = dbRound(locked[k] - dbRound(refund))
+		}
+		for k, v := range locked {
+			if v != 0 {
+				t.Errorf("round %d: %s locked of user %d is %v after all orders closed, want 0", round, k.asset, k.userID, v)
+			}
+		}
+		if trades == 0 {
+			t.Fatalf("round %d: no trades matched", round)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrSubAccountNotFound = errors.New("sub-account not found")
+
+type SubAccount struct {
+	ID        int       `json:"id"`
+	MasterID  int       `json:"master_id"`
+	Label     string    `json:"label"`
+	Frozen    bool      `json:"frozen"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AssetBalance struct {
+	Asset     string  `json:"asset"`
+	Available float64 `json:"available"`
+	Locked    float64 `json:"locked"`
+}
+
+// AccountPosition: Số dư và lệnh đang mở của một tài khoản (master hoặc sub)
+type AccountPosition struct {
+	UserID     int            `json:"user_id"`
+	Label      string         `json:"label"`
+	Frozen     bool           `json:"frozen"`
+	Balances   []AssetBalance `json:"balances"`
+	OpenOrders int            `json:"open_orders"`
+}
+
+// AccountOverview: Tổng hợp số dư của master và toàn bộ sub-account
+type AccountOverview struct {
+	MasterID int               `json:"master_id"`
+	Totals   []AssetBalance    `json:"totals"`
+	Accounts []AccountPosition `json:"accounts"`
+}
+
+func CreateSubAccount(db *pgxpool.Pool, masterID int, label string) (*SubAccount, error) {
+	if label == "" {
+		return nil, errors.New("label is required")
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Chỉ tài khoản gốc mới được tạo sub-account (không lồng nhiều cấp)
+	var masterEmail string
+	var parentID *int
+	err = tx.QueryRow(ctx,
+		`SELECT email, parent_id FROM users WHERE id=$1 FOR UPDATE`,
+		masterID).Scan(&masterEmail, &parentID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errors.New("master account not found")
+		}
+		return nil, err
+	}
+	if parentID != nil {
+		return nil, errors.New("sub-accounts cannot have sub-accounts")
+	}
+
+	// Sub-account không đăng nhập được: email nội bộ, không có password
+	sub := SubAccount{MasterID: masterID, Label: label}
+	email := fmt.Sprintf("%d.%s@subaccount.local", masterID, label)
+	err = tx.QueryRow(ctx,
+		`INSERT INTO users (email, password_hash, parent_id, label)
+		 VALUES ($1, '', $2, $3)
+		 RETURNING id, created_at`,
+		email, masterID, label).Scan(&sub.ID, &sub.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	log.Printf("CreateSubAccount: Master %d (%s) created sub-account %d (%s)", masterID, masterEmail, sub.ID, label)
+	return &sub, nil
+}
+
+func ListSubAccounts(db *pgxpool.Pool, masterID int) ([]SubAccount, error) {
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT id, parent_id, label, frozen, created_at
+		 FROM users
+		 WHERE parent_id=$1
+		 ORDER BY id`,
+		masterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := make([]SubAccount, 0)
+	for rows.Next() {
+		var sub SubAccount
+		if err := rows.Scan(&sub.ID, &sub.MasterID, &sub.Label, &sub.Frozen, &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// SetSubAccountFrozen: Đóng băng/mở băng sub-account. Lệnh đang mở vẫn giữ nguyên trên sổ.
+func SetSubAccountFrozen(db *pgxpool.Pool, masterID, subID int, frozen bool) error {
+	ctx := context.Background()
+	tag, err := db.Exec(ctx,
+		`UPDATE users SET frozen=$1 WHERE id=$2 AND parent_id=$3`,
+		frozen, subID, masterID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSubAccountNotFound
+	}
+
+	log.Printf("SetSubAccountFrozen: Master %d set sub-account %d frozen=%v", masterID, subID, frozen)
+	return nil
+}
+
+// IsSubAccountOf: userID là chính master hoặc một sub-account của master
+func IsSubAccountOf(db *pgxpool.Pool, masterID, userID int) (bool, error) {
+	if masterID == userID {
+		return true, nil
+	}
+
+	ctx := context.Background()
+	var ok bool
+	err := db.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM users WHERE id=$1 AND parent_id=$2)`,
+		userID, masterID).Scan(&ok)
+	return ok, err
+}
+
+// SubAccountTransfer: Master chuyển tiền giữa chính mình và các sub-account.
+// Sub-account đang bị đóng băng chỉ được rút tiền về master, không chuyển sang sub khác.
+func SubAccountTransfer(db *pgxpool.Pool, masterID, fromUserID, toUserID int, asset string, amount float64, idempotencyKey string) (*Transfer, error) {
+	for _, id := range []int{fromUserID, toUserID} {
+		ok, err := IsSubAccountOf(db, masterID, id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrSubAccountNotFound
+		}
+	}
+
+	return internalTransfer(db, fromUserID, toUserID, asset, amount, idempotencyKey, toUserID == masterID)
+}
+
+// GetAccountOverview: Số dư từng tài khoản và tổng theo asset của master + các sub-account
+func GetAccountOverview(db *pgxpool.Pool, masterID int) (*AccountOverview, error) {
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT u.id, COALESCE(u.label, ''), u.frozen,
+		        b.asset_symbol, b.available, b.locked,
+		        (SELECT COUNT(*) FROM orders o WHERE o.user_id = u.id AND o.status IN ('OPEN', 'PARTIAL'))
+		 FROM users u
+		 LEFT JOIN balances b ON b.user_id = u.id
+		 WHERE u.id=$1 OR u.parent_id=$1
+		 ORDER BY u.id, b.asset_symbol`,
+		masterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overview := AccountOverview{MasterID: masterID, Totals: make([]AssetBalance, 0), Accounts: make([]AccountPosition, 0)}
+	totals := make(map[string]int) // asset -> index trong overview.Totals
+
+	for rows.Next() {
+		var userID, openOrders int
+		var label string
+		var frozen bool
+		var asset *string
+		var available, locked *float64
+		if err := rows.Scan(&userID, &label, &frozen, &asset, &available, &locked, &openOrders); err != nil {
+			return nil, err
+		}
+
+		n := len(overview.Accounts)
+		if n == 0 || overview.Accounts[n-1].UserID != userID {
+			overview.Accounts = append(overview.Accounts, AccountPosition{
+				UserID:     userID,
+				Label:      label,
+				Frozen:     frozen,
+				Balances:   make([]AssetBalance, 0),
+				OpenOrders: openOrders,
+			})
+			n++
+		}
+		if asset == nil {
+			continue // Tài khoản chưa có balance nào
+		}
+
+		bal := AssetBalance{Asset: *asset, Available: *available, Locked: *locked}
+		overview.Accounts[n-1].Balances = append(overview.Accounts[n-1].Balances, bal)
+
+		i, ok := totals[bal.Asset]
+		if !ok {
+			i = len(overview.Totals)
+			totals[bal.Asset] = i
+			overview.Totals = append(overview.Totals, AssetBalance{Asset: bal.Asset})
+		}
+		overview.Totals[i].Available += bal.Available
+		overview.Totals[i].Locked += bal.Locked
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(overview.Accounts) == 0 {
+		return nil, errors.New("master account not found")
+	}
+	return &overview, nil
+}
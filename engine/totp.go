@@ -0,0 +1,345 @@
+package engine
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TOTP theo RFC 6238: HMAC-SHA1, 6 chữ số, bước 30 giây (tương thích Google Authenticator)
+const (
+	TOTPIssuer        = "SimpleCEX"
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpSkew          = 1 // Chấp nhận lệch ±1 bước do đồng hồ điện thoại
+	recoveryCodeCount = 10
+	recoveryCodeHalf  = 5 // Recovery code dạng "xxxxx-xxxxx"
+
+	// Nhập sai mã 2FA MaxOTPFailures lần liên tiếp -> khoá OTPLockoutDuration, kể cả khi đúng mật khẩu
+	MaxOTPFailures     = 5
+	OTPLockoutDuration = 15 * time.Minute
+)
+
+var (
+	ErrOTPRequired        = errors.New("2fa code required")
+	ErrInvalidOTP         = errors.New("invalid 2fa code")
+	ErrOTPLocked          = errors.New("too many invalid 2fa codes, try again later")
+	Err2FAAlreadyEnabled  = errors.New("2fa is already enabled")
+	Err2FANotEnabled      = errors.New("2fa is not enabled")
+	Err2FASetupNotStarted = errors.New("2fa setup has not been started")
+	ErrUserNotFound       = errors.New("user not found")
+)
+
+var totpSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPSetup: Trả về cho client một lần khi bắt đầu đăng ký 2FA
+type TOTPSetup struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"` // otpauth://... để tạo mã QR
+}
+
+// totpCode: HOTP(secret, counter) rút gọn thành 6 chữ số
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP: Tìm bước thời gian khớp với code, bỏ qua các bước <= lastStep để một code không dùng được hai lần
+func matchTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpSecretEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func provisioningURI(email, secret string) string {
+	label := url.PathEscape(TOTPIssuer + ":" + email)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", TOTPIssuer)
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// normalizeOTP bỏ khoảng trắng/gạch ngang để người dùng nhập kiểu nào cũng được
+func normalizeOTP(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// SetupTOTP: Sinh secret mới (chưa bật 2FA cho tới khi EnableTOTP xác nhận được code)
+func SetupTOTP(db *pgxpool.Pool, userID int) (*TOTPSetup, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	secret := totpSecretEncoding.EncodeToString(raw)
+
+	ctx := context.Background()
+	var email string
+	err := db.QueryRow(ctx,
+		`UPDATE users SET totp_secret=$1, totp_last_step=0
+		 WHERE id=$2 AND NOT totp_enabled
+		 RETURNING email`,
+		secret, userID).Scan(&email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, Err2FAAlreadyEnabled
+		}
+		return nil, err
+	}
+
+	return &TOTPSetup{Secret: secret, ProvisioningURI: provisioningURI(email, secret)}, nil
+}
+
+// EnableTOTP: Xác nhận code từ app rồi bật 2FA, trả về recovery codes (chỉ hiển thị một lần)
+func EnableTOTP(db *pgxpool.Pool, userID int, code string) ([]string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var secret *string
+	var enabled bool
+	var lastStep int64
+	err = tx.QueryRow(ctx,
+		`SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id=$1 FOR UPDATE`,
+		userID).Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if enabled {
+		return nil, Err2FAAlreadyEnabled
+	}
+	if secret == nil {
+		return nil, Err2FASetupNotStarted
+	}
+
+	step, ok := matchTOTP(*secret, normalizeOTP(code), time.Now(), lastStep)
+	if !ok {
+		return nil, ErrInvalidOTP
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE users SET totp_enabled=true, totp_last_step=$1 WHERE id=$2`,
+		step, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	log.Printf("EnableTOTP: User %d enabled 2FA", userID)
+	return codes, nil
+}
+
+// DisableTOTP: Phải xác thực lại bằng TOTP hoặc recovery code
+func DisableTOTP(db *pgxpool.Pool, userID int, code string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	enabled, err := verifySecondFactor(ctx, tx, userID, code)
+	if err != nil {
+		return commitOTPFailure(ctx, tx, err)
+	}
+	if !enabled {
+		return Err2FANotEnabled
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE users SET totp_enabled=false, totp_secret=NULL, totp_last_step=0 WHERE id=$1`,
+		userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM totp_recovery_codes WHERE user_id=$1`, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	log.Printf("DisableTOTP: User %d disabled 2FA", userID)
+	return nil
+}
+
+// VerifySecondFactor: Dùng trước các thao tác nhạy cảm. User chưa bật 2FA thì luôn qua.
+// code có thể là TOTP 6 số hoặc một recovery code chưa dùng.
+func VerifySecondFactor(db *pgxpool.Pool, userID int, code string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := verifySecondFactor(ctx, tx, userID, code); err != nil {
+		return commitOTPFailure(ctx, tx, err)
+	}
+	return tx.Commit(ctx)
+}
+
+// commitOTPFailure: Lần nhập sai đã được đếm trong tx, phải commit thay vì rollback rồi mới trả lỗi
+func commitOTPFailure(ctx context.Context, tx pgx.Tx, err error) error {
+	if errors.Is(err, ErrInvalidOTP) {
+		if cerr := tx.Commit(ctx); cerr != nil {
+			return cerr
+		}
+	}
+	return err
+}
+
+// verifySecondFactor khoá dòng user để một code không thể dùng song song hai lần.
+// Trả về enabled=false (không lỗi) nếu user chưa bật 2FA.
+// Mỗi lần sai được đếm trong tx (caller commit qua commitOTPFailure); sai đủ MaxOTPFailures lần thì khoá tạm.
+func verifySecondFactor(ctx context.Context, tx pgx.Tx, userID int, code string) (bool, error) {
+	var secret *string
+	var enabled, locked bool
+	var lastStep int64
+	err := tx.QueryRow(ctx,
+		`SELECT totp_secret, totp_enabled, totp_last_step, COALESCE(totp_locked_until > NOW(), false)
+		 FROM users WHERE id=$1 FOR UPDATE`,
+		userID).Scan(&secret, &enabled, &lastStep, &locked)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, ErrUserNotFound
+		}
+		return false, err
+	}
+	if !enabled {
+		return false, nil
+	}
+
+	code = normalizeOTP(code)
+	if code == "" {
+		return true, ErrOTPRequired
+	}
+	if locked {
+		return true, ErrOTPLocked
+	}
+
+	if len(code) == totpDigits && secret != nil {
+		step, ok := matchTOTP(*secret, code, time.Now(), lastStep)
+		if !ok {
+			return true, recordOTPFailure(ctx, tx, userID)
+		}
+		_, err = tx.Exec(ctx,
+			`UPDATE users SET totp_last_step=$1, totp_failed_attempts=0, totp_locked_until=NULL WHERE id=$2`,
+			step, userID)
+		return true, err
+	}
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE totp_recovery_codes SET used_at=NOW()
+		 WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL`,
+		userID, hashToken(code))
+	if err != nil {
+		return true, err
+	}
+	if tag.RowsAffected() == 0 {
+		return true, recordOTPFailure(ctx, tx, userID)
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE users SET totp_failed_attempts=0, totp_locked_until=NULL WHERE id=$1`,
+		userID)
+	if err != nil {
+		return true, err
+	}
+	log.Printf("verifySecondFactor: User %d used a recovery code", userID)
+	return true, nil
+}
+
+// recordOTPFailure: Tăng bộ đếm sai; đủ MaxOTPFailures thì khoá và đếm lại từ đầu. Trả về ErrInvalidOTP.
+func recordOTPFailure(ctx context.Context, tx pgx.Tx, userID int) error {
+	var lockedOut bool
+	err := tx.QueryRow(ctx,
+		`UPDATE users
+		 SET totp_failed_attempts = CASE WHEN totp_failed_attempts + 1 >= $2 THEN 0 ELSE totp_failed_attempts + 1 END,
+		     totp_locked_until = CASE WHEN totp_failed_attempts + 1 >= $2 THEN NOW() + $3 * INTERVAL '1 second' ELSE totp_locked_until END
+		 WHERE id=$1
+		 RETURNING totp_failed_attempts = 0`,
+		userID, MaxOTPFailures, OTPLockoutDuration.Seconds()).Scan(&lockedOut)
+	if err != nil {
+		return err
+	}
+	if lockedOut {
+		log.Printf("verifySecondFactor: User %d locked out of 2FA for %s after %d invalid codes", userID, OTPLockoutDuration, MaxOTPFailures)
+	}
+	return ErrInvalidOTP
+}
+
+// replaceRecoveryCodes: Xoá code cũ, sinh bộ mới. DB chỉ lưu SHA-256.
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec(ctx, `DELETE FROM totp_recovery_codes WHERE user_id=$1`, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw, err := randomHex(recoveryCodeHalf)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = raw[:recoveryCodeHalf] + "-" + raw[recoveryCodeHalf:]
+		hashes[i] = hashToken(raw)
+	}
+
+	_, err := tx.Exec(ctx,
+		`INSERT INTO totp_recovery_codes (user_id, code_hash)
+		 SELECT $1, unnest($2::text[])`,
+		userID, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// Vector của RFC 6238 phụ lục B (SHA1, secret ASCII "12345678901234567890").
+// RFC dùng 8 chữ số; mã 6 chữ số là 6 chữ số cuối.
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		if got := totpCode(rfc6238Secret, uint64(v.unix/totpPeriod)); got != v.code {
+			t.Errorf("T=%d: got %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpSecretEncoding.EncodeToString(rfc6238Secret)
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+
+	if got, ok := matchTOTP(secret, "050471", now, 0); !ok || got != step {
+		t.Fatalf("current code: got step %d ok=%v, want %d", got, ok, step)
+	}
+	// Lệch một bước (đồng hồ điện thoại chậm/nhanh) vẫn được chấp nhận
+	if _, ok := matchTOTP(secret, "050471", now.Add(totpPeriod*time.Second), 0); !ok {
+		t.Error("code from previous step rejected")
+	}
+	if _, ok := matchTOTP(secret, "050471", now.Add(2*totpPeriod*time.Second), 0); ok {
+		t.Error("code two steps old accepted")
+	}
+	// Bước đã dùng không được dùng lại
+	if _, ok := matchTOTP(secret, "050471", now, step); ok {
+		t.Error("reused code accepted")
+	}
+	if _, ok := matchTOTP(secret, "000000", now, 0); ok {
+		t.Error("wrong code accepted")
+	}
+	if _, ok := matchTOTP("not base32!", "050471", now, 0); ok {
+		t.Error("invalid secret accepted")
+	}
+}
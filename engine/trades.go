@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UserTrade: Một lần khớp nhìn từ phía user (mỗi trade tạo 2 fill: maker và taker)
+type UserTrade struct {
+	TradeID        int64     `json:"trade_id"`
+	Symbol         string    `json:"symbol"`
+	OrderID        int       `json:"order_id"`
+	CounterOrderID int       `json:"counterparty_order_id"`
+	Side           string    `json:"side"`
+	Role           string    `json:"role"` // MAKER hoặc TAKER
+	Price          float64   `json:"price"`
+	Amount         float64   `json:"amount"`
+	Fee            float64   `json:"fee"`
+	FeeAsset       string    `json:"fee_asset,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// TradeFilter: Các trường rỗng/zero nghĩa là không lọc
+type TradeFilter struct {
+	Symbol   string
+	From     time.Time // created_at >= From
+	To       time.Time // created_at < To
+	BeforeID int64     // Phân trang: chỉ lấy các trade có id < BeforeID
+	Limit    int
+}
+
+// ListUserTrades: Lịch sử khớp lệnh của user, mới nhất trước.
+// Ghép trades với lệnh maker và lệnh taker; trade tự khớp (cùng user hai phía) trả về cả 2 fill.
+// Hai fill của một trade không bị tách ra hai trang (cursor là trade id), nên trang có thể dài hơn Limit 1 dòng.
+func ListUserTrades(db *pgxpool.Pool, userID int, f TradeFilter) ([]UserTrade, error) {
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return nil, fmt.Errorf("%w: start_time must be before end_time", ErrInvalidOrderFilter)
+	}
+	if f.Limit <= 0 || f.Limit > 500 {
+		f.Limit = 100
+	}
+	var from, to *time.Time
+	if !f.From.IsZero() {
+		from = &f.From
+	}
+	if !f.To.IsZero() {
+		to = &f.To
+	}
+
+	// Điều kiện chung cho cả 2 nhánh (o là lệnh của user)
+	const where = `o.user_id = $1
+		   AND ($2 = '' OR t.symbol = $2)
+		   AND ($3::timestamp IS NULL OR t.created_at >= $3)
+		   AND ($4::timestamp IS NULL OR t.created_at < $4)
+		   AND ($5::bigint = 0 OR t.id < $5)`
+
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT * FROM (
+		   SELECT t.id AS trade_id, t.symbol, o.id AS order_id, t.taker_order_id, o.side, 'MAKER' AS role, t.price, t.amount,
+		          t.maker_fee, COALESCE(t.maker_fee_asset, ''), t.created_at
+		   FROM trades t JOIN orders o ON o.id = t.maker_order_id
+		   WHERE `+where+`
+		   UNION ALL
+		   SELECT t.id, t.symbol, o.id, t.maker_order_id, o.side, 'TAKER' AS role, t.price, t.amount,
+		          t.taker_fee, COALESCE(t.taker_fee_asset, ''), t.created_at
+		   FROM trades t JOIN orders o ON o.id = t.taker_order_id
+		   WHERE `+where+`
+		 ) fills
+		 ORDER BY trade_id DESC, role
+		 LIMIT $6`,
+		userID, f.Symbol, from, to, f.BeforeID, f.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trades := make([]UserTrade, 0)
+	for rows.Next() {
+		var t UserTrade
+		if err := rows.Scan(&t.TradeID, &t.Symbol, &t.OrderID, &t.CounterOrderID, &t.Side, &t.Role,
+			&t.Price, &t.Amount, &t.Fee, &t.FeeAsset, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		trades = append(trades, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Lấy dư 1 dòng: nếu đó là fill còn lại của trade cuối trang thì giữ, không thì bỏ
+	if len(trades) > f.Limit && trades[f.Limit].TradeID != trades[f.Limit-1].TradeID {
+		trades = trades[:f.Limit]
+	}
+	return trades, nil
+}
+
+// ListRecentTrades: Các trade gần nhất của market, mới nhất trước
+func ListRecentTrades(db *pgxpool.Pool, symbol string, limit int) ([]PublicTrade, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT id, symbol, price, amount, taker_side, created_at
+		 FROM trades
+		 WHERE symbol = $1
+		 ORDER BY id DESC
+		 LIMIT $2`,
+		symbol, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trades := make([]PublicTrade, 0)
+	for rows.Next() {
+		var t PublicTrade
+		if err := rows.Scan(&t.ID, &t.Symbol, &t.Price, &t.Amount, &t.TakerSide, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		trades = append(trades, t)
+	}
+	return trades, rows.Err()
+}
@@ -0,0 +1,208 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different transfer")
+
+type Transfer struct {
+	ID             int       `json:"id"`
+	FromUserID     int       `json:"from_user_id"`
+	ToUserID       int       `json:"to_user_id"`
+	Asset          string    `json:"asset"`
+	Amount         float64   `json:"amount"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+const transferColumns = `id, from_user_id, to_user_id, asset_symbol, amount, idempotency_key, created_at`
+
+func scanTransfer(row pgx.Row) (*Transfer, error) {
+	var t Transfer
+	err := row.Scan(&t.ID, &t.FromUserID, &t.ToUserID, &t.Asset, &t.Amount, &t.IdempotencyKey, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SameAccountTree: Hai user có cùng master không (master và các sub-account của nó)
+func SameAccountTree(db *pgxpool.Pool, userA, userB int) (bool, error) {
+	ctx := context.Background()
+	var same bool
+	err := db.QueryRow(ctx, sameAccountTreeSQL, userA, userB).Scan(&same)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, ErrUserNotFound
+	}
+	return same, err
+}
+
+const sameAccountTreeSQL = `SELECT COALESCE(a.parent_id, a.id) = COALESCE(b.parent_id, b.id)
+	 FROM users a, users b WHERE a.id=$1 AND b.id=$2`
+
+// InternalTransfer: Chuyển available của một asset từ user này sang user khác trong một transaction.
+// Gọi lại với cùng idempotencyKey sẽ trả về transfer cũ thay vì chuyển thêm lần nữa.
+// Chuyển ra ngoài master/sub-account của user là rút tiền khỏi tài khoản nên tính vào hạn mức rút 24h theo tier.
+func InternalTransfer(db *pgxpool.Pool, fromUserID, toUserID int, asset string, amount float64, idempotencyKey string) (*Transfer, error) {
+	return internalTransfer(db, fromUserID, toUserID, asset, amount, idempotencyKey, false)
+}
+
+// internalTransfer: allowFrozen cho phép master rút tiền về từ sub-account đang bị đóng băng
+func internalTransfer(db *pgxpool.Pool, fromUserID, toUserID int, asset string, amount float64, idempotencyKey string, allowFrozen bool) (*Transfer, error) {
+	if amount <= 0 {
+		return nil, errors.New("amount must be positive")
+	}
+	if fromUserID == toUserID {
+		return nil, errors.New("cannot transfer to the same account")
+	}
+	if idempotencyKey == "" {
+		return nil, errors.New("idempotency key is required")
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		log.Printf("InternalTransfer: Failed to begin transaction for user %d: %v", fromUserID, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// 1. Bên nhận có thể chưa có dòng balance cho asset này -> tạo sẵn
+	_, err = tx.Exec(ctx,
+		`INSERT INTO balances (user_id, asset_symbol) VALUES ($1,$2)
+		 ON CONFLICT (user_id, asset_symbol) DO NOTHING`,
+		toUserID, asset)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Khoá cả 2 dòng balance theo thứ tự user_id để 2 chiều chuyển ngược nhau không deadlock
+	rows, err := tx.Query(ctx,
+		`SELECT b.user_id, b.available, u.frozen FROM balances b
+		 JOIN users u ON u.id = b.user_id
+		 WHERE b.asset_symbol=$1 AND b.user_id IN ($2,$3)
+		 ORDER BY b.user_id
+		 FOR UPDATE OF b`,
+		asset, fromUserID, toUserID)
+	if err != nil {
+		return nil, err
+	}
+	var available float64
+	var frozen, found bool
+	for rows.Next() {
+		var uid int
+		var avail float64
+		var f bool
+		if err := rows.Scan(&uid, &avail, &f); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if uid == fromUserID {
+			available, frozen, found = avail, f, true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// 3. Kiểm tra idempotency sau khi đã khoá balance bên gửi: 2 request trùng key sẽ xếp hàng ở đây
+	existing, err := scanTransfer(tx.QueryRow(ctx,
+		`SELECT `+transferColumns+` FROM transfers
+		 WHERE from_user_id=$1 AND idempotency_key=$2`,
+		fromUserID, idempotencyKey))
+	if err == nil {
+		if existing.ToUserID != toUserID || existing.Asset != asset || math.Abs(existing.Amount-amount) > 1e-8 {
+			return nil, ErrIdempotencyKeyReused
+		}
+		log.Printf("InternalTransfer: Replay of transfer #%d (key %s)", existing.ID, idempotencyKey)
+		return existing, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	if frozen && !allowFrozen {
+		return nil, ErrAccountFrozen
+	}
+	if !found || available < amount {
+		log.Printf("InternalTransfer: User %d insufficient %s balance: %f < %f", fromUserID, asset, available, amount)
+		return nil, ErrInsufficientBalance
+	}
+
+	// Balance bên gửi đang bị khoá nên các transfer/lệnh rút song song không cùng lọt qua hạn mức
+	var sameTree bool
+	if err := tx.QueryRow(ctx, sameAccountTreeSQL, fromUserID, toUserID).Scan(&sameTree); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if !sameTree {
+		limit, err := getWithdrawalLimit(ctx, tx, fromUserID, asset)
+		if err != nil {
+			return nil, err
+		}
+		if amount > limit.Remaining {
+			log.Printf("InternalTransfer: User %d exceeds daily %s limit: used %f + %f > %f", fromUserID, asset, limit.Used, amount, limit.DailyLimit)
+			return nil, ErrDailyLimitExceeded
+		}
+	}
+
+	// 4. Ghi transfer và chuyển tiền
+	t, err := scanTransfer(tx.QueryRow(ctx,
+		`INSERT INTO transfers (from_user_id, to_user_id, asset_symbol, amount, idempotency_key)
+		 VALUES ($1,$2,$3,$4,$5)
+		 RETURNING `+transferColumns,
+		fromUserID, toUserID, asset, amount, idempotencyKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addLedgerEntry(ctx, tx, fromUserID, asset, -amount, 0, LedgerTransferOut, t.ID); err != nil {
+		return nil, err
+	}
+	if err := addLedgerEntry(ctx, tx, toUserID, asset, amount, 0, LedgerTransferIn, t.ID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	log.Printf("InternalTransfer: #%d %f %s from user %d to user %d", t.ID, amount, asset, fromUserID, toUserID)
+	return t, nil
+}
+
+// ListTransfers: Lịch sử chuyển nội bộ (cả chiều gửi và nhận) của user
+func ListTransfers(db *pgxpool.Pool, userID int) ([]Transfer, error) {
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT `+transferColumns+` FROM transfers
+		 WHERE from_user_id=$1 OR to_user_id=$1
+		 ORDER BY id DESC
+		 LIMIT 100`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := make([]Transfer, 0)
+	for rows.Next() {
+		t, err := scanTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, *t)
+	}
+	return transfers, rows.Err()
+}
@@ -0,0 +1,457 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Địa chỉ mới thêm vào whitelist phải chờ hết khoảng thời gian này mới được rút
+const WithdrawalAddressCoolingOff = 24 * time.Hour
+
+// Trạng thái của một lệnh rút
+const (
+	WithdrawalPendingReview = "PENDING_REVIEW" // Số lượng lớn, chờ admin duyệt
+	WithdrawalApproved      = "APPROVED"       // Đã duyệt, chờ chuyển tiền ra ngoài
+	WithdrawalRejected      = "REJECTED"
+	WithdrawalCancelled     = "CANCELLED"
+	WithdrawalCompleted     = "COMPLETED"
+)
+
+var (
+	ErrAddressNotWhitelisted  = errors.New("withdrawal address is not whitelisted")
+	ErrAddressCoolingOff      = errors.New("withdrawal address is still in its cooling-off period")
+	ErrDailyLimitExceeded     = errors.New("daily withdrawal limit exceeded")
+	ErrWithdrawalNotFound     = errors.New("withdrawal not found")
+	ErrWithdrawalInvalidState = errors.New("withdrawal cannot be changed in its current status")
+)
+
+type WithdrawalAddress struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Asset     string    `json:"asset"`
+	Address   string    `json:"address"`
+	Label     string    `json:"label"`
+	CreatedAt time.Time `json:"created_at"`
+	ActiveAt  time.Time `json:"active_at"`
+}
+
+type Withdrawal struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Asset      string     `json:"asset"`
+	Address    string     `json:"address"`
+	Amount     float64    `json:"amount"`
+	Status     string     `json:"status"`
+	ReviewedBy *int       `json:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+	Note       *string    `json:"note,omitempty"`
+	TxHash     *string    `json:"tx_hash,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// WithdrawalLimit: Hạn mức rút 24h của user cho một asset
+type WithdrawalLimit struct {
+	Tier            int     `json:"tier"`
+	Asset           string  `json:"asset"`
+	DailyLimit      float64 `json:"daily_limit"`
+	Used            float64 `json:"used"`
+	Remaining       float64 `json:"remaining"`
+	ReviewThreshold float64 `json:"review_threshold"`
+}
+
+const withdrawalColumns = `id, user_id, asset_symbol, address, amount, status, reviewed_by, reviewed_at, note, tx_hash, created_at`
+
+func scanWithdrawal(row pgx.Row) (*Withdrawal, error) {
+	var w Withdrawal
+	err := row.Scan(&w.ID, &w.UserID, &w.Asset, &w.Address, &w.Amount, &w.Status,
+		&w.ReviewedBy, &w.ReviewedAt, &w.Note, &w.TxHash, &w.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func AddWithdrawalAddress(db *pgxpool.Pool, userID int, asset, address, label string) (*WithdrawalAddress, error) {
+	ctx := context.Background()
+	a := WithdrawalAddress{UserID: userID, Asset: asset, Address: address, Label: label}
+	err := db.QueryRow(ctx,
+		`INSERT INTO withdrawal_addresses (user_id, asset_symbol, address, label, active_at)
+		 VALUES ($1,$2,$3,$4, NOW() + $5 * INTERVAL '1 second')
+		 RETURNING id, created_at, active_at`,
+		userID, asset, address, label, WithdrawalAddressCoolingOff.Seconds()).
+		Scan(&a.ID, &a.CreatedAt, &a.ActiveAt)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("AddWithdrawalAddress: User %d whitelisted %s address %s, active at %s", userID, asset, address, a.ActiveAt)
+	return &a, nil
+}
+
+func ListWithdrawalAddresses(db *pgxpool.Pool, userID int) ([]WithdrawalAddress, error) {
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT id, user_id, asset_symbol, address, COALESCE(label, ''), created_at, active_at
+		 FROM withdrawal_addresses
+		 WHERE user_id=$1
+		 ORDER BY id`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := make([]WithdrawalAddress, 0)
+	for rows.Next() {
+		var a WithdrawalAddress
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Asset, &a.Address, &a.Label, &a.CreatedAt, &a.ActiveAt); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, a)
+	}
+	return addresses, rows.Err()
+}
+
+func RemoveWithdrawalAddress(db *pgxpool.Pool, userID, addressID int) error {
+	ctx := context.Background()
+	tag, err := db.Exec(ctx,
+		`DELETE FROM withdrawal_addresses WHERE id=$1 AND user_id=$2`,
+		addressID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAddressNotWhitelisted
+	}
+	return nil
+}
+
+// getWithdrawalLimit đọc hạn mức theo tier của user và tổng đã rút trong 24h gần nhất.
+// Lệnh REJECTED/CANCELLED không tính vào hạn mức; chuyển nội bộ ra ngoài master/sub-account của user thì có tính.
+func getWithdrawalLimit(ctx context.Context, q pgx.Tx, userID int, asset string) (*WithdrawalLimit, error) {
+	l := WithdrawalLimit{Asset: asset}
+	err := q.QueryRow(ctx,
+		`SELECT u.verification_tier, wl.daily_limit, wl.review_threshold
+		 FROM users u
+		 JOIN withdrawal_limits wl ON wl.tier = u.verification_tier AND wl.asset_symbol = $2
+		 WHERE u.id = $1`,
+		userID, asset).Scan(&l.Tier, &l.DailyLimit, &l.ReviewThreshold)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errors.New("withdrawals are not available for this asset at your verification tier")
+		}
+		return nil, err
+	}
+
+	err = q.QueryRow(ctx,
+		`SELECT (SELECT COALESCE(SUM(amount), 0)
+		         FROM withdrawals
+		         WHERE user_id=$1 AND asset_symbol=$2
+		           AND status NOT IN ('REJECTED', 'CANCELLED')
+		           AND created_at > NOW() - INTERVAL '24 hours')
+		      + (SELECT COALESCE(SUM(t.amount), 0)
+		         FROM transfers t
+		         JOIN users f ON f.id = t.from_user_id
+		         JOIN users r ON r.id = t.to_user_id
+		         WHERE t.from_user_id=$1 AND t.asset_symbol=$2
+		           AND t.created_at > NOW() - INTERVAL '24 hours'
+		           AND COALESCE(f.parent_id, f.id) <> COALESCE(r.parent_id, r.id))`,
+		userID, asset).Scan(&l.Used)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Remaining = l.DailyLimit - l.Used
+	if l.Remaining < 0 {
+		l.Remaining = 0
+	}
+	return &l, nil
+}
+
+func GetWithdrawalLimit(db *pgxpool.Pool, userID int, asset string) (*WithdrawalLimit, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	return getWithdrawalLimit(ctx, tx, userID, asset)
+}
+
+// RequestWithdrawal: Tạo lệnh rút và giữ (hold) số tiền tương ứng.
+// Tiền chuyển từ available sang locked cho tới khi lệnh rút hoàn tất hoặc bị huỷ.
+func RequestWithdrawal(db *pgxpool.Pool, userID int, asset, address string, amount float64) (*Withdrawal, error) {
+	if amount <= 0 {
+		return nil, errors.New("amount must be positive")
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		log.Printf("RequestWithdrawal: Failed to begin transaction for user %d: %v", userID, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// 1. Khoá balance trước để các lệnh rút song song của cùng user phải xếp hàng
+	//    (tránh 2 lệnh cùng lọt qua kiểm tra hạn mức)
+	var available float64
+	var frozen bool
+	err = tx.QueryRow(ctx,
+		`SELECT b.available, u.frozen FROM balances b
+		 JOIN users u ON u.id = b.user_id
+		 WHERE b.user_id=$1 AND b.asset_symbol=$2 FOR UPDATE OF b`,
+		userID, asset).Scan(&available, &frozen)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrInsufficientBalance
+		}
+		return nil, err
+	}
+	if frozen {
+		return nil, ErrAccountFrozen
+	}
+	if available < amount {
+		log.Printf("RequestWithdrawal: User %d insufficient %s balance: %f < %f", userID, asset, available, amount)
+		return nil, ErrInsufficientBalance
+	}
+
+	// 2. Địa chỉ phải nằm trong whitelist và đã qua thời gian chờ
+	var active bool
+	err = tx.QueryRow(ctx,
+		`SELECT active_at <= NOW() FROM withdrawal_addresses
+		 WHERE user_id=$1 AND asset_symbol=$2 AND address=$3`,
+		userID, asset, address).Scan(&active)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrAddressNotWhitelisted
+		}
+		return nil, err
+	}
+	if !active {
+		return nil, ErrAddressCoolingOff
+	}
+
+	// 3. Kiểm tra hạn mức 24h theo tier
+	limit, err := getWithdrawalLimit(ctx, tx, userID, asset)
+	if err != nil {
+		return nil, err
+	}
+	if amount > limit.Remaining {
+		log.Printf("RequestWithdrawal: User %d exceeds daily %s limit: used %f + %f > %f", userID, asset, limit.Used, amount, limit.DailyLimit)
+		return nil, ErrDailyLimitExceeded
+	}
+
+	// 4. Lệnh lớn phải qua hàng đợi duyệt tay
+	status := WithdrawalApproved
+	if amount >= limit.ReviewThreshold {
+		status = WithdrawalPendingReview
+	}
+
+	w, err := scanWithdrawal(tx.QueryRow(ctx,
+		`INSERT INTO withdrawals (user_id, asset_symbol, address, amount, status)
+		 VALUES ($1,$2,$3,$4,$5)
+		 RETURNING `+withdrawalColumns,
+		userID, asset, address, amount, status))
+	if err != nil {
+		return nil, err
+	}
+
+	// 5. Hold tiền: available -> locked
+	if err := addLedgerEntry(ctx, tx, userID, asset, -amount, amount, LedgerWithdrawalHold, w.ID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	log.Printf("RequestWithdrawal: User %d withdrawal #%d %f %s -> %s (%s)", userID, w.ID, amount, asset, address, status)
+	return w, nil
+}
+
+func ListWithdrawals(db *pgxpool.Pool, userID int) ([]Withdrawal, error) {
+	return queryWithdrawals(db,
+		`SELECT `+withdrawalColumns+` FROM withdrawals WHERE user_id=$1 ORDER BY id DESC LIMIT 100`,
+		userID)
+}
+
+// ListWithdrawalsByStatus: Dùng cho hàng đợi duyệt của admin (cũ nhất lên trước)
+func ListWithdrawalsByStatus(db *pgxpool.Pool, status string) ([]Withdrawal, error) {
+	return queryWithdrawals(db,
+		`SELECT `+withdrawalColumns+` FROM withdrawals WHERE status=$1 ORDER BY id LIMIT 500`,
+		status)
+}
+
+func queryWithdrawals(db *pgxpool.Pool, sql string, args ...interface{}) ([]Withdrawal, error) {
+	ctx := context.Background()
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	withdrawals := make([]Withdrawal, 0)
+	for rows.Next() {
+		w, err := scanWithdrawal(rows)
+		if err != nil {
+			return nil, err
+		}
+		withdrawals = append(withdrawals, *w)
+	}
+	return withdrawals, rows.Err()
+}
+
+// lockWithdrawal khoá lệnh rút và kiểm tra trạng thái hiện tại nằm trong danh sách cho phép
+func lockWithdrawal(ctx context.Context, tx pgx.Tx, withdrawalID int, allowed ...string) (*Withdrawal, error) {
+	w, err := scanWithdrawal(tx.QueryRow(ctx,
+		`SELECT `+withdrawalColumns+` FROM withdrawals WHERE id=$1 FOR UPDATE`,
+		withdrawalID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrWithdrawalNotFound
+		}
+		return nil, err
+	}
+
+	for _, s := range allowed {
+		if w.Status == s {
+			return w, nil
+		}
+	}
+	return nil, ErrWithdrawalInvalidState
+}
+
+// releaseWithdrawal: Trả tiền đang hold về available và đóng lệnh rút với trạng thái status
+func releaseWithdrawal(ctx context.Context, tx pgx.Tx, w *Withdrawal, status string, reviewerID *int, note string) error {
+	_, err := tx.Exec(ctx,
+		`SELECT 1 FROM balances WHERE user_id=$1 AND asset_symbol=$2 FOR UPDATE`,
+		w.UserID, w.Asset)
+	if err != nil {
+		return err
+	}
+
+	if err := addLedgerEntry(ctx, tx, w.UserID, w.Asset, w.Amount, -w.Amount, LedgerWithdrawalRelease, w.ID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE withdrawals
+		 SET status=$1, reviewed_by=COALESCE($2, reviewed_by), reviewed_at=NOW(), note=NULLIF($3, '')
+		 WHERE id=$4`,
+		status, reviewerID, note, w.ID)
+	return err
+}
+
+// CancelWithdrawal: User tự huỷ lệnh rút chưa được chuyển đi
+func CancelWithdrawal(db *pgxpool.Pool, userID, withdrawalID int) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	w, err := lockWithdrawal(ctx, tx, withdrawalID, WithdrawalPendingReview, WithdrawalApproved)
+	if err != nil {
+		return err
+	}
+	if w.UserID != userID {
+		return ErrWithdrawalNotFound
+	}
+
+	if err := releaseWithdrawal(ctx, tx, w, WithdrawalCancelled, nil, ""); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ApproveWithdrawal: Admin duyệt lệnh rút lớn trong hàng đợi
+func ApproveWithdrawal(db *pgxpool.Pool, withdrawalID, reviewerID int, note string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := lockWithdrawal(ctx, tx, withdrawalID, WithdrawalPendingReview); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE withdrawals
+		 SET status=$1, reviewed_by=$2, reviewed_at=NOW(), note=NULLIF($3, '')
+		 WHERE id=$4`,
+		WithdrawalApproved, reviewerID, note, withdrawalID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("ApproveWithdrawal: Withdrawal #%d approved by %d", withdrawalID, reviewerID)
+	return tx.Commit(ctx)
+}
+
+// RejectWithdrawal: Admin từ chối lệnh rút, tiền hold được trả lại cho user
+func RejectWithdrawal(db *pgxpool.Pool, withdrawalID, reviewerID int, note string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	w, err := lockWithdrawal(ctx, tx, withdrawalID, WithdrawalPendingReview, WithdrawalApproved)
+	if err != nil {
+		return err
+	}
+
+	if err := releaseWithdrawal(ctx, tx, w, WithdrawalRejected, &reviewerID, note); err != nil {
+		return err
+	}
+
+	log.Printf("RejectWithdrawal: Withdrawal #%d rejected by %d: %s", withdrawalID, reviewerID, note)
+	return tx.Commit(ctx)
+}
+
+// CompleteWithdrawal: Đánh dấu lệnh rút đã chuyển ra ngoài, trừ hẳn phần tiền đang hold
+func CompleteWithdrawal(db *pgxpool.Pool, withdrawalID int, txHash string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	w, err := lockWithdrawal(ctx, tx, withdrawalID, WithdrawalApproved)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		`SELECT 1 FROM balances WHERE user_id=$1 AND asset_symbol=$2 FOR UPDATE`,
+		w.UserID, w.Asset)
+	if err != nil {
+		return err
+	}
+
+	if err := addLedgerEntry(ctx, tx, w.UserID, w.Asset, 0, -w.Amount, LedgerWithdrawal, w.ID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE withdrawals SET status=$1, tx_hash=$2 WHERE id=$3`,
+		WithdrawalCompleted, txHash, withdrawalID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("CompleteWithdrawal: Withdrawal #%d completed, tx %s", withdrawalID, txHash)
+	return tx.Commit(ctx)
+}
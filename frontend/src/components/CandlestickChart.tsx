@@ -21,75 +21,6 @@ interface CandlestickData {
   close: number;
 }
 
-// Hàm cập nhật chart khi có trade mới
-const updateChartWithTrade = (
-  candlestickSeries: any,
-  tradePrice: number,
-  tradeTime: number,
-  currentInterval: string = '1m'
-) => {
-  if (!candlestickSeries) return;
-
-  // Tính timestamp của nến (làm tròn xuống theo interval)
-  const tradeTimeSeconds = Math.floor(tradeTime / 1000);
-  let intervalSeconds = 60; // 1m default
-  
-  switch (currentInterval) {
-    case '1m':
-      intervalSeconds = 60;
-      break;
-    case '5m':
-      intervalSeconds = 300;
-      break;
-    case '15m':
-      intervalSeconds = 900;
-      break;
-    case '1h':
-      intervalSeconds = 3600;
-      break;
-  }
-  
-  const candleTime = Math.floor(tradeTimeSeconds / intervalSeconds) * intervalSeconds;
-
-  // Lấy dữ liệu hiện tại (nếu có method data())
-  let existingData: any[] = [];
-  if (typeof candlestickSeries.data === 'function') {
-    existingData = candlestickSeries.data();
-  }
-  
-  // Tìm nến hiện tại trong data
-  let currentCandle: any = null;
-  for (let i = existingData.length - 1; i >= 0; i--) {
-    const candle = existingData[i];
-    if (candle && candle.time === candleTime) {
-      currentCandle = candle;
-      break;
-    }
-  }
-
-  if (currentCandle) {
-    // Cập nhật nến hiện có
-    const updatedCandle: CandlestickData = {
-      time: candleTime,
-      open: currentCandle.open,
-      high: Math.max(currentCandle.high, tradePrice),
-      low: Math.min(currentCandle.low, tradePrice),
-      close: tradePrice,
-    };
-    candlestickSeries.update(updatedCandle);
-  } else {
-    // Tạo nến mới
-    const newCandle: CandlestickData = {
-      time: candleTime,
-      open: tradePrice,
-      high: tradePrice,
-      low: tradePrice,
-      close: tradePrice,
-    };
-    candlestickSeries.update(newCandle);
-  }
-};
-
 export default function CandlestickChart() {
   const chartContainerRef = useRef<HTMLDivElement>(null);
   const chartRef = useRef<ReturnType<typeof createChart> | null>(null);
@@ -97,7 +28,6 @@ export default function CandlestickChart() {
   const [isLoading, setIsLoading] = useState(true);
   const [interval, setInterval] = useState<string>('1m'); // 1m, 5m, 15m, 1h
   const wsRef = useRef<WebSocket | null>(null);
-  const intervalRef = useRef<number | null>(null);
 
   useEffect(() => {
     if (!chartContainerRef.current) return;
@@ -195,26 +125,29 @@ export default function CandlestickChart() {
           // Fetch dữ liệu ban đầu
           fetchData(interval);
 
-          // 4. Tự động cập nhật chart mỗi 1 giây
-          intervalRef.current = window.setInterval(() => {
-            fetchData(interval);
-          }, 1000); // 1000ms = 1 giây
-
-          // 5. Kết nối WebSocket để nhận trade updates real-time
+          // 4. Kết nối WebSocket để nhận nến (kline) real-time từ server
           const ws = new WebSocket(`${WS_URL}/ws`);
           wsRef.current = ws;
 
           ws.onopen = () => {
             console.log("Chart WebSocket connected");
+            ws.send(JSON.stringify({ op: "subscribe", id: 1, topics: [`kline_${interval}@BTC_USDT`] }));
           };
 
           ws.onmessage = (event) => {
             try {
               const data = JSON.parse(event.data);
               
-              // Xử lý TRADE_UPDATE để cập nhật chart (chỉ update real-time khi interval là 1m)
-              if (data.type === "TRADE_UPDATE" && data.symbol === "BTC_USDT" && candlestickSeries && interval === '1m') {
-                updateChartWithTrade(candlestickSeries, data.price, data.time, interval);
+              // KLINE: nến đang mở (closed=false) hoặc bản cuối khi hết khung, cùng dữ liệu với REST
+              if (data.type === "KLINE" && data.symbol === "BTC_USDT" && data.interval === interval) {
+                const candle: OHLCV = data.candle;
+                candlestickSeries.update({
+                  time: candle.time / 1000,
+                  open: candle.open,
+                  high: candle.high,
+                  low: candle.low,
+                  close: candle.close,
+                });
               }
             } catch (error) {
               console.error("Error parsing WebSocket message:", error);
@@ -268,11 +201,6 @@ export default function CandlestickChart() {
       if (cleanupFn) {
         cleanupFn();
       }
-      // Clear interval
-      if (intervalRef.current) {
-        clearInterval(intervalRef.current);
-        intervalRef.current = null;
-      }
       // Đóng WebSocket
       if (wsRef.current) {
         wsRef.current.close();
@@ -6,26 +6,96 @@ export default function OrderForm() {
   const [side, setSide] = useState<'BUY' | 'SELL'>('BUY');
   const [price, setPrice] = useState('');
   const [amount, setAmount] = useState('');
-  const [userID, setUserID] = useState('1'); // Giả lập User ID (sau này sẽ lấy từ Login)
+  const [email, setEmail] = useState('userA@test.com');
+  const [password, setPassword] = useState('');
+  const [token, setToken] = useState(() => localStorage.getItem('token') || '');
+
+  const handleLogin = async (otp?: string) => {
+    try {
+      const res = await axios.post(`${API_URL}/login`, { email, password, otp });
+      localStorage.setItem('token', res.data.token);
+      setToken(res.data.token);
+      setPassword('');
+    } catch (error) {
+      console.error(error);
+      // Tài khoản đã bật 2FA: hỏi mã từ app rồi đăng nhập lại
+      if (axios.isAxiosError(error) && error.response?.data?.['2fa_required']) {
+        const code = window.prompt("Nhập mã 2FA (hoặc recovery code)");
+        if (code) handleLogin(code);
+        return;
+      }
+      alert("Sai email hoặc mật khẩu");
+    }
+  };
+
+  const handleLogout = async () => {
+    try {
+      await axios.post(`${API_URL}/logout`, null, {
+        headers: { Authorization: `Bearer ${token}` }
+      });
+    } catch (error) {
+      console.error(error);
+    }
+    localStorage.removeItem('token');
+    setToken('');
+  };
 
   const handleSubmit = async () => {
     try {
-      // Gọi API Backend
+      // Gọi API Backend, user lấy từ session token
       await axios.post(`${API_URL}/order`, {
-        user_id: parseInt(userID),
         symbol: "BTC_USDT",
         side: side,
         price: parseFloat(price),
         amount: parseFloat(amount)
+      }, {
+        headers: { Authorization: `Bearer ${token}` }
       });
       alert("Đặt lệnh thành công!");
       // Reset form (tuỳ chọn)
     } catch (error) {
       console.error(error);
+      if (axios.isAxiosError(error) && error.response?.status === 401) {
+        localStorage.removeItem('token');
+        setToken('');
+      }
       alert("Lỗi đặt lệnh");
     }
   };
 
+  if (!token) {
+    return (
+      <div className="p-4 bg-gray-900 rounded-lg w-full max-w-md h-fit">
+        <div className="space-y-3">
+          <div>
+              <label className="text-xs text-gray-400">Email</label>
+              <input 
+                  type="email" 
+                  className="w-full bg-gray-800 text-white p-2 rounded outline-none border border-gray-700 focus:border-yellow-500"
+                  value={email}
+                  onChange={e => setEmail(e.target.value)}
+              />
+          </div>
+          <div>
+              <label className="text-xs text-gray-400">Password</label>
+              <input 
+                  type="password" 
+                  className="w-full bg-gray-800 text-white p-2 rounded outline-none border border-gray-700 focus:border-yellow-500"
+                  value={password}
+                  onChange={e => setPassword(e.target.value)}
+              />
+          </div>
+          <button 
+              onClick={() => handleLogin()}
+              className="w-full py-3 rounded font-bold mt-4 bg-yellow-600 hover:bg-yellow-500"
+          >
+              Login
+          </button>
+        </div>
+      </div>
+    );
+  }
+
   return (
     <div className="p-4 bg-gray-900 rounded-lg w-full max-w-md h-fit">
       {/* Tab Mua/Bán */}
@@ -46,14 +116,11 @@ export default function OrderForm() {
 
       {/* Input Form */}
       <div className="space-y-3">
-        <div>
-            <label className="text-xs text-gray-400">User ID (Simulate)</label>
-            <input 
-                type="number" 
-                className="w-full bg-gray-800 text-white p-2 rounded outline-none border border-gray-700 focus:border-yellow-500"
-                value={userID}
-                onChange={e => setUserID(e.target.value)}
-            />
+        <div className="flex justify-between items-center">
+            <span className="text-xs text-gray-400">{email}</span>
+            <button onClick={handleLogout} className="text-xs text-gray-400 hover:text-white">
+                Logout
+            </button>
         </div>
         <div>
             <label className="text-xs text-gray-400">Price (USDT)</label>
@@ -1,22 +1,92 @@
 import { useEffect, useState } from 'react';
-import { WS_URL } from '../config';
+import { API_URL, WS_URL } from '../config';
 
-// Định nghĩa kiểu dữ liệu cho Lệnh
-interface Order {
-  ID: number;
-  Price: number;
-  Amount: number;
+const SYMBOL = "BTC_USDT";
+
+// Một mức giá đã gộp (amount = 0 trong diff nghĩa là xoá mức giá)
+interface PriceLevel {
+  price: number;
+  amount: number;
 }
 
 interface OrderBookData {
-  bids: Order[]; // Người mua (Xanh)
-  asks: Order[]; // Người bán (Đỏ)
+  bids: PriceLevel[]; // Người mua (Xanh)
+  asks: PriceLevel[]; // Người bán (Đỏ)
+}
+
+interface DepthUpdate {
+  firstUpdateId: number;
+  lastUpdateId: number;
+  bids: PriceLevel[];
+  asks: PriceLevel[];
+}
+
+// Áp dụng diff vào một bên của sổ cục bộ (Map giá -> số lượng)
+function applyLevels(side: Map<number, number>, levels: PriceLevel[]) {
+  for (const l of levels) {
+    if (l.amount === 0) {
+      side.delete(l.price);
+    } else {
+      side.set(l.price, l.amount);
+    }
+  }
+}
+
+// Lấy 10 mức giá tốt nhất để hiển thị
+function topLevels(side: Map<number, number>, desc: boolean): PriceLevel[] {
+  return [...side.entries()]
+    .sort((a, b) => (desc ? b[0] - a[0] : a[0] - b[0]))
+    .slice(0, 10)
+    .map(([price, amount]) => ({ price, amount }));
 }
 
 export default function OrderBook() {
   const [book, setBook] = useState<OrderBookData>({ bids: [], asks: [] });
 
   useEffect(() => {
+    // Sổ cục bộ: snapshot REST + các DEPTH_UPDATE nối tiếp theo update ID
+    const bids = new Map<number, number>();
+    const asks = new Map<number, number>();
+    let lastUpdateId = -1; // -1: chưa có snapshot
+    let buffered: DepthUpdate[] = [];
+    let closed = false;
+
+    const render = () => setBook({ bids: topLevels(bids, true), asks: topLevels(asks, false) });
+
+    const applyUpdate = (u: DepthUpdate): boolean => {
+      if (u.lastUpdateId <= lastUpdateId) return true; // Đã có trong snapshot
+      if (u.firstUpdateId !== lastUpdateId + 1) return false; // Mất diff -> phải lấy lại snapshot
+      applyLevels(bids, u.bids);
+      applyLevels(asks, u.asks);
+      lastUpdateId = u.lastUpdateId;
+      return true;
+    };
+
+    const resync = async () => {
+      lastUpdateId = -1;
+      try {
+        const res = await fetch(`${API_URL}/orderbook/${SYMBOL}?limit=1000`);
+        const snapshot = await res.json();
+        if (closed) return;
+        bids.clear();
+        asks.clear();
+        applyLevels(bids, snapshot.bids || []);
+        applyLevels(asks, snapshot.asks || []);
+        lastUpdateId = snapshot.lastUpdateId;
+        const pending = buffered;
+        buffered = [];
+        for (const u of pending) {
+          if (!applyUpdate(u)) {
+            resync();
+            return;
+          }
+        }
+        render();
+      } catch (error) {
+        console.error("Failed to load orderbook snapshot:", error);
+      }
+    };
+
     // 1. Kết nối WebSocket tới Backend
     const ws = new WebSocket(`${WS_URL}/ws`);
     let isConnected = false;
@@ -24,6 +94,9 @@ export default function OrderBook() {
     ws.onopen = () => {
       console.log("Connected to WebSocket");
       isConnected = true;
+      // Subscribe trước rồi mới lấy snapshot để không bỏ sót diff nào
+      ws.send(JSON.stringify({ op: "subscribe", id: 1, topics: [`depth@${SYMBOL}`] }));
+      resync();
     };
 
     ws.onerror = (error) => {
@@ -38,23 +111,24 @@ export default function OrderBook() {
     ws.onmessage = (event) => {
       try {
         const data = JSON.parse(event.data);
-        // Chỉ cập nhật khi message type là ORDERBOOK_UPDATE
-        if (data.type === "ORDERBOOK_UPDATE") {
-          // Giới hạn chỉ hiển thị 10 orders cho mỗi bên
-          const bids = (data.bids || []).slice(0, 10);
-          const asks = (data.asks || []).slice(0, 10);
-          
-          setBook({
-              bids: bids,
-              asks: asks
-          });
+        if (data.type !== "DEPTH_UPDATE") return;
+        if (lastUpdateId < 0) {
+          buffered.push(data); // Đang chờ snapshot
+          return;
+        }
+        if (!applyUpdate(data)) {
+          buffered = [data];
+          resync();
+          return;
         }
+        render();
       } catch (error) {
         console.error("Error parsing WebSocket message:", error);
       }
     };
 
     return () => {
+      closed = true;
       // Chỉ đóng nếu đã kết nối
       if (isConnected && ws.readyState === WebSocket.OPEN) {
         ws.close();
@@ -74,24 +148,24 @@ export default function OrderBook() {
       {/* ASKS (Người bán - Màu Đỏ) - Xếp ngược từ cao xuống thấp để giá thấp nhất ở gần giữa */}
       <div className="flex flex-col-reverse mb-2"> 
         {book.asks.map((ask) => (
-          <div key={ask.ID} className="flex justify-between text-red-500 font-mono hover:bg-gray-800 cursor-pointer">
-            <span>{ask.Price.toLocaleString()}</span>
-            <span>{ask.Amount.toFixed(4)}</span>
+          <div key={ask.price} className="flex justify-between text-red-500 font-mono hover:bg-gray-800 cursor-pointer">
+            <span>{ask.price.toLocaleString()}</span>
+            <span>{ask.amount.toFixed(4)}</span>
           </div>
         ))}
       </div>
 
       {/* Giá hiện tại (Current Price) - Để trống hoặc giả lập */}
       <div className="py-2 text-center text-xl font-bold text-white border-y border-gray-700 my-2">
-         {book.bids.length > 0 ? book.bids[0].Price.toLocaleString() : "---"}
+         {book.bids.length > 0 ? book.bids[0].price.toLocaleString() : "---"}
       </div>
 
       {/* BIDS (Người mua - Màu Xanh) */}
       <div>
         {book.bids.map((bid) => (
-          <div key={bid.ID} className="flex justify-between text-green-500 font-mono hover:bg-gray-800 cursor-pointer">
-            <span>{bid.Price.toLocaleString()}</span>
-            <span>{bid.Amount.toFixed(4)}</span>
+          <div key={bid.price} className="flex justify-between text-green-500 font-mono hover:bg-gray-800 cursor-pointer">
+            <span>{bid.price.toLocaleString()}</span>
+            <span>{bid.amount.toFixed(4)}</span>
           </div>
         ))}
       </div>
@@ -13,6 +13,8 @@ import (
 // Cấu hình
 const (
 	API_URL    = "http://localhost:8010/order"
+	LOGIN_URL  = "http://localhost:8010/login"
+	PASSWORD   = "password123" // Password của các user trong seed
 	SYMBOL     = "BTC_USDT"
 	BASE_PRICE = 50000.0 // Giá mốc Bitcoin
 	NUM_USERS  = 10      // Số lượng user giả lập
@@ -37,7 +39,6 @@ const (
 )
 
 type OrderRequest struct {
-	UserID int     `json:"user_id"`
 	Symbol string  `json:"symbol"`
 	Side   string  `json:"side"`
 	Price  float64 `json:"price"`
@@ -48,6 +49,16 @@ func main() {
 	fmt.Println("🚀 STARTING MARKET SIMULATION...")
 	fmt.Println("Press Ctrl+C to stop")
 
+	// 0. Đăng nhập tất cả user để lấy session token
+	for i := 1; i <= NUM_USERS; i++ {
+		token, err := login(userEmail(i))
+		if err != nil {
+			fmt.Printf("[User %d] Login failed: %v\n", i, err)
+			return
+		}
+		tokens[i] = token
+	}
+
 	var wg sync.WaitGroup
 
 	// 1. Chạy Bot Market Maker (User 1 - Luôn giữ Orderbook dày)
@@ -159,16 +170,54 @@ func runSmallTrader(userID int) {
 	}
 }
 
+// Session token theo userID, chỉ ghi trong main trước khi các bot chạy
+var tokens = make(map[int]string)
+
+// userEmail: User 1 trong init.sql là userA, user 2-10 từ seed_simulation.sql
+func userEmail(userID int) string {
+	if userID == 1 {
+		return "userA@test.com"
+	}
+	return fmt.Sprintf("user%d@test.com", userID)
+}
+
+func login(email string) (string, error) {
+	reqBody, _ := json.Marshal(map[string]string{"email": email, "password": PASSWORD})
+	resp, err := http.Post(LOGIN_URL, "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", err
+	}
+	return session.Token, nil
+}
+
 func placeOrder(userID int, side string, price, amount float64) {
 	reqBody, _ := json.Marshal(OrderRequest{
-		UserID: userID,
 		Symbol: SYMBOL,
 		Side:   side,
 		Price:  price,
 		Amount: amount,
 	})
 
-	resp, err := http.Post(API_URL, "application/json", bytes.NewBuffer(reqBody))
+	req, err := http.NewRequest("POST", API_URL, bytes.NewBuffer(reqBody))
+	if err != nil {
+		fmt.Printf("[User %d] Error: %v\n", userID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+tokens[userID])
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		fmt.Printf("[User %d] Error: %v\n", userID, err)
 		return